@@ -0,0 +1,240 @@
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/golang/snappy"
+)
+
+// The binary encoding written by MarshalBinary and MarshalBinaryCompressed. All integers are
+// unsigned varints (as in encoding/binary) unless they're single bytes:
+//
+//	version      1 byte, binaryVersion
+//	flags        1 byte, the binaryFlag bits below
+//	p            1 byte
+//	pPrime       1 byte
+//	hash name    length and bytes, only if binaryFlagHashID is set
+//	hash seed    varint, only if binaryFlagHashID is set
+//	numElements  varint, only if the sketch is sparse
+//	lastVal      varint, only if the sketch is sparse
+//	checksum     1 byte for the Checksum, then a varint, only if binaryFlagChecksum is set
+//	payload      the rest of the buffer, compressed with snappy if binaryFlagCompressed is set
+//
+// The payload of a sparse sketch is its sparse list: the encoded hashes sorted by index, as varint
+// deltas from the previous one, numElements of them in all, the last being lastVal. The payload of
+// a dense sketch is its 2^p registers in the packed 6-bit layout of normal, which takes
+// (3*2^p)/4 + 1 bytes. The temp set is merged into the sparse list before marshaling, so it's never
+// part of the encoding.
+//
+// The checksum is of the uncompressed encoding of the sketch without a checksum, as computed by
+// checksumOf. JSON and protobuf encodings embed the same checksum.
+const binaryVersion = 1
+
+const (
+	binaryFlagDense      = 1 << iota // the sketch is dense, otherwise it's sparse
+	binaryFlagCompressed             // the payload is compressed with snappy
+	binaryFlagHashID                 // the hash ID is recorded
+	binaryFlagChecksum               // the checksum is recorded
+
+	binaryFlagsKnown = binaryFlagDense | binaryFlagCompressed | binaryFlagHashID |
+		binaryFlagChecksum
+)
+
+// ErrInvalidEncoding is matched (using errors.Is) by the errors returned when UnmarshalBinary,
+// UnmarshalJSON, UnmarshalPb or GobDecode is given a buffer that isn't a valid encoding of an Hll.
+var ErrInvalidEncoding = errors.New("hll: invalid encoding")
+
+// MarshalBinary implements encoding.BinaryMarshaler. The encoding is compact and has a stable,
+// versioned layout, which is documented with binaryVersion in the source. The payload isn't
+// compressed; see MarshalBinaryCompressed.
+func (h *Hll) MarshalBinary() ([]byte, error) {
+	return h.marshalBinary(false), nil
+}
+
+// MarshalBinaryCompressed is like MarshalBinary, but compresses the sparse list or the registers
+// with snappy. UnmarshalBinary accepts either form.
+func (h *Hll) MarshalBinaryCompressed() ([]byte, error) {
+	return h.marshalBinary(true), nil
+}
+
+func (h *Hll) marshalBinary(compress bool) []byte {
+	h.mergeTmpSetIfAny()
+
+	var bigM normal
+	var payload []byte
+	if h.isSparse {
+		payload = h.sparseList.buf
+	} else {
+		bigM = h.bigM.packed(h.m)
+		payload = bigM
+	}
+	hdr := newBinaryHeader(h.p, h.pPrime, h.hashID, bigM, h.sparseList)
+	if h.checksum != ChecksumNone {
+		hdr.flags |= binaryFlagChecksum
+		hdr.checksum = h.checksum
+		hdr.sum = checksumOf(h.checksum, h.p, h.pPrime, h.hashID, bigM, h.sparseList)
+	}
+	if compress {
+		hdr.flags |= binaryFlagCompressed
+		payload = snappy.Encode(nil, payload)
+	}
+
+	buf := hdr.appendTo(make([]byte, 0, hdr.size()+len(payload)))
+	return append(buf, payload...)
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It accepts the output of MarshalBinary and
+// MarshalBinaryCompressed, and returns an error that wraps ErrInvalidEncoding if buf isn't one, or
+// ErrCorrupt if buf doesn't match its checksum. Like the other unmarshaling functions, it gives h
+// the default sparse threshold and merge size, and the packed register layout. h doesn't keep a
+// reference to buf.
+func (h *Hll) UnmarshalBinary(buf []byte) error {
+	hdr, buf, err := readBinaryHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	// A sparse list is at most maxSparseBytes, and the registers are smaller than that.
+	var payload []byte
+	if hdr.flags&binaryFlagCompressed != 0 {
+		if payload, err = snappyDecode(buf, maxSparseBytes(maxP)); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+		}
+	} else {
+		payload = make([]byte, len(buf))
+		copy(payload, buf)
+	}
+	if payload == nil {
+		payload = []byte{}
+	}
+
+	var bigM normal
+	var sparseList *sparse
+	if hdr.flags&binaryFlagDense != 0 {
+		bigM = normal(payload)
+	} else {
+		sparseList = &sparse{payload, hdr.lastVal, hdr.numElements}
+	}
+	decoded, err := newDecoded(hdr.p, hdr.pPrime, bigM, sparseList, hdr.hashID, hdr.checksum,
+		hdr.sum)
+	if err != nil {
+		return err
+	}
+
+	*h = *decoded
+	return nil
+}
+
+// The fields of the binary encoding that come before the payload.
+type binaryHeader struct {
+	flags                byte
+	p, pPrime            uint
+	hashID               HashID
+	numElements, lastVal uint64 // only if the sketch is sparse
+	checksum             Checksum
+	sum                  uint64
+}
+
+// Returns the header of an uncompressed encoding without a checksum of a sketch whose
+// representation is bigM (packed) if it's dense, and sparseList if it's sparse.
+func newBinaryHeader(p, pPrime uint, hashID HashID, bigM normal, sparseList *sparse) binaryHeader {
+	hdr := binaryHeader{p: p, pPrime: pPrime, hashID: hashID}
+	if !hashID.IsZero() {
+		hdr.flags |= binaryFlagHashID
+	}
+	if bigM != nil {
+		hdr.flags |= binaryFlagDense
+	} else {
+		hdr.numElements, hdr.lastVal = sparseList.numElements, sparseList.lastVal
+	}
+	return hdr
+}
+
+// Returns the largest number of bytes that appendTo adds.
+func (hdr *binaryHeader) size() int {
+	return 5 + 4*binary.MaxVarintLen64 + len(hdr.hashID.Name)
+}
+
+// Appends the encoding of hdr to buf.
+func (hdr *binaryHeader) appendTo(buf []byte) []byte {
+	buf = append(buf, binaryVersion, hdr.flags, byte(hdr.p), byte(hdr.pPrime))
+	if hdr.flags&binaryFlagHashID != 0 {
+		buf = appendUvarint(buf, uint64(len(hdr.hashID.Name)))
+		buf = append(buf, hdr.hashID.Name...)
+		buf = appendUvarint(buf, hdr.hashID.Seed)
+	}
+	if hdr.flags&binaryFlagDense == 0 {
+		buf = appendUvarint(buf, hdr.numElements)
+		buf = appendUvarint(buf, hdr.lastVal)
+	}
+	if hdr.flags&binaryFlagChecksum != 0 {
+		buf = append(buf, byte(hdr.checksum))
+		buf = appendUvarint(buf, hdr.sum)
+	}
+	return buf
+}
+
+// Reads the header at the start of buf, and returns it and the payload that follows it.
+func readBinaryHeader(buf []byte) (binaryHeader, []byte, error) {
+	var hdr binaryHeader
+	if len(buf) < 4 {
+		return hdr, nil, fmt.Errorf("%w: %d bytes is too short for the header", ErrInvalidEncoding,
+			len(buf))
+	}
+	version := buf[0]
+	hdr.flags, hdr.p, hdr.pPrime = buf[1], uint(buf[2]), uint(buf[3])
+	if version != binaryVersion {
+		return hdr, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidEncoding, version)
+	}
+	if hdr.flags&^binaryFlagsKnown != 0 {
+		return hdr, nil, fmt.Errorf("%w: unknown flags %#x", ErrInvalidEncoding, hdr.flags)
+	}
+	buf = buf[4:]
+
+	var err error
+	if hdr.flags&binaryFlagHashID != 0 {
+		var nameLen uint64
+		if nameLen, buf, err = readUvarint(buf, "hash name length"); err != nil {
+			return hdr, nil, err
+		}
+		if nameLen > uint64(len(buf)) {
+			return hdr, nil, fmt.Errorf("%w: truncated hash name", ErrInvalidEncoding)
+		}
+		hdr.hashID.Name = string(buf[:nameLen])
+		if hdr.hashID.Seed, buf, err = readUvarint(buf[nameLen:], "hash seed"); err != nil {
+			return hdr, nil, err
+		}
+	}
+
+	if hdr.flags&binaryFlagDense == 0 {
+		if hdr.numElements, buf, err = readUvarint(buf, "number of elements"); err != nil {
+			return hdr, nil, err
+		}
+		if hdr.lastVal, buf, err = readUvarint(buf, "last value"); err != nil {
+			return hdr, nil, err
+		}
+	}
+
+	if hdr.flags&binaryFlagChecksum != 0 {
+		if len(buf) == 0 || buf[0] == byte(ChecksumNone) {
+			return hdr, nil, fmt.Errorf("%w: missing checksum type", ErrInvalidEncoding)
+		}
+		hdr.checksum = Checksum(buf[0])
+		if hdr.sum, buf, err = readUvarint(buf[1:], "checksum"); err != nil {
+			return hdr, nil, err
+		}
+	}
+	return hdr, buf, nil
+}
+
+// Reads a uvarint from the start of buf, and returns it and the rest of buf. The error describes
+// the value as what.
+func readUvarint(buf []byte, what string) (uint64, []byte, error) {
+	x, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, nil, fmt.Errorf("%w: bad varint for the %s", ErrInvalidEncoding, what)
+	}
+	return x, buf[n:], nil
+}
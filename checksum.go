@@ -0,0 +1,106 @@
+package hll
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Checksum selects the checksum that MarshalBinary, MarshalBinaryCompressed, MarshalJSON, MarshalPb
+// and GobEncode embed in the encoding of a sketch, so that a stored sketch that was damaged is
+// detected when it's unmarshaled, instead of silently inflating every sketch it's combined with.
+// The checksum covers the parameters, the hash ID and the sparse list or registers. The default is
+// ChecksumNone.
+type Checksum uint8
+
+const (
+	// ChecksumNone embeds no checksum.
+	ChecksumNone Checksum = iota
+	// ChecksumCRC32C embeds the CRC-32 with the Castagnoli polynomial, which is hardware
+	// accelerated on most CPUs.
+	ChecksumCRC32C
+	// ChecksumXXHash64 embeds the xxHash64 with a seed of 0, which detects more errors than a
+	// CRC-32 at the cost of a larger checksum.
+	ChecksumXXHash64
+
+	numChecksums
+)
+
+func (c Checksum) String() string {
+	switch c {
+	case ChecksumNone:
+		return "none"
+	case ChecksumCRC32C:
+		return "crc32c"
+	case ChecksumXXHash64:
+		return "xxhash64"
+	}
+	return fmt.Sprintf("Checksum(%d)", uint8(c))
+}
+
+// ErrCorrupt is matched (using errors.Is) by the errors returned when a sketch is unmarshaled from
+// a buffer that doesn't match the checksum embedded in it.
+var ErrCorrupt = errors.New("hll: checksum mismatch")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Returns the checksum of b. c must be ChecksumCRC32C or ChecksumXXHash64.
+func (c Checksum) sum(b []byte) uint64 {
+	if c == ChecksumCRC32C {
+		return uint64(crc32.Checksum(b, crc32cTable))
+	}
+	return xxhash64(b, 0)
+}
+
+// Returns the checksum c of a sketch whose representation is bigM (packed) if it's dense, and
+// sparseList if it's sparse: the checksum of its uncompressed binary encoding without a checksum.
+// That way a sketch has the same checksum in every encoding.
+func checksumOf(c Checksum, p, pPrime uint, hashID HashID, bigM normal, sparseList *sparse) uint64 {
+	hdr := newBinaryHeader(p, pPrime, hashID, bigM, sparseList)
+	payload := []byte(bigM)
+	if bigM == nil {
+		payload = sparseList.buf
+	}
+	buf := hdr.appendTo(make([]byte, 0, hdr.size()+len(payload)))
+	return c.sum(append(buf, payload...))
+}
+
+// Checks a decoded sketch against the checksum sum of type c that was embedded in its encoding.
+// It returns an error that wraps ErrCorrupt if they don't match, or ErrInvalidEncoding if c isn't a
+// known checksum.
+func verifyChecksum(c Checksum, sum uint64, p, pPrime uint, hashID HashID, bigM normal,
+	sparseList *sparse) error {
+	if c == ChecksumNone {
+		if sum != 0 {
+			return fmt.Errorf("%w: checksum without a checksum type", ErrInvalidEncoding)
+		}
+		return nil
+	}
+	if c >= numChecksums {
+		return fmt.Errorf("%w: unknown checksum type %d", ErrInvalidEncoding, uint8(c))
+	}
+	if actual := checksumOf(c, p, pPrime, hashID, bigM, sparseList); actual != sum {
+		return fmt.Errorf("%w: the %v of the sketch is %#x, but %#x is recorded", ErrCorrupt, c,
+			actual, sum)
+	}
+	return nil
+}
+
+// Verify checks that buf is a sketch marshaled by MarshalBinary, MarshalBinaryCompressed,
+// MarshalJSON, MarshalPb or GobEncode, and that it matches the checksum embedded in it, without
+// keeping the sketch. It's meant for scrubbing stored sketches. It returns an error that wraps
+// ErrCorrupt if the checksum doesn't match, or ErrInvalidEncoding if buf isn't a valid encoding. A
+// sketch that was marshaled without a checksum can only be checked for being valid.
+func Verify(buf []byte) error {
+	h := &Hll{}
+	// The encodings start with different bytes: JSON with an object, the binary encoding with its
+	// version, and the protobuf encoding with the tag of p.
+	switch {
+	case len(buf) > 0 && buf[0] == '{':
+		return h.UnmarshalJSON(buf)
+	case len(buf) > 0 && buf[0] == binaryVersion:
+		return h.UnmarshalBinary(buf)
+	default:
+		return h.UnmarshalPb(buf)
+	}
+}
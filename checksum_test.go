@@ -0,0 +1,159 @@
+package hll
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/gogo/protobuf/proto"
+)
+
+// The ways of marshaling a sketch, with the matching ways of unmarshaling it.
+var checksumCodecs = []struct {
+	name      string
+	marshal   func(h *Hll) ([]byte, error)
+	unmarshal func(h *Hll, buf []byte) error
+}{
+	{"binary", (*Hll).MarshalBinary, (*Hll).UnmarshalBinary},
+	{"compressed", (*Hll).MarshalBinaryCompressed, (*Hll).UnmarshalBinary},
+	{"json", (*Hll).MarshalJSON, (*Hll).UnmarshalJSON},
+	{"pb", (*Hll).MarshalPb, (*Hll).UnmarshalPb},
+	{"gob", (*Hll).GobEncode, (*Hll).GobDecode},
+}
+
+func TestChecksumRoundTrip(t *testing.T) {
+	for _, c := range []Checksum{ChecksumNone, ChecksumCRC32C, ChecksumXXHash64} {
+		h, err := New(WithP(10), WithChecksum(c), WithHasher(XXHash64{1}))
+		assert.Equal(t, nil, err)
+		for i := 0; i < 2000; i++ {
+			if i == 20 || i == 1999 {
+				for _, codec := range checksumCodecs {
+					buf, err := codec.marshal(h)
+					assert.Equal(t, nil, err)
+					assert.Equalf(t, Verify(buf), nil, "%v %s", c, codec.name)
+
+					rt := &Hll{}
+					assert.Equal(t, codec.unmarshal(rt, buf), nil)
+					assert.Equal(t, rt.checksum, c)
+					assert.Equal(t, rt.Cardinality(), h.Cardinality())
+
+					// The sketch embeds the same checksum when it's marshaled again.
+					again, err := codec.marshal(rt)
+					assert.Equal(t, nil, err)
+					assert.Equalf(t, again, buf, "%v %s", c, codec.name)
+				}
+			}
+			h.AddUint64Value(uint64(i))
+		}
+		assert.T(t, !h.isSparse)
+	}
+}
+
+func TestChecksumOf(t *testing.T) {
+	// The checksum is of the uncompressed binary encoding without a checksum.
+	h := NewHll(10, 25)
+	h.AddString("a")
+	plain, err := h.MarshalBinary()
+	assert.Equal(t, nil, err)
+	h.checksum = ChecksumCRC32C
+	buf, err := h.MarshalBinary()
+	assert.Equal(t, nil, err)
+	sum := uint64(crc32.Checksum(plain, crc32.MakeTable(crc32.Castagnoli)))
+	hdr, _, err := readBinaryHeader(buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, hdr.checksum, ChecksumCRC32C)
+	assert.Equal(t, hdr.sum, sum)
+
+	// The JSON and protobuf encodings embed the same checksum.
+	jBuf, err := h.MarshalJSON()
+	assert.Equal(t, nil, err)
+	j := jsonableHll{}
+	assert.Equal(t, json.Unmarshal(jBuf, &j), nil)
+	assert.Equal(t, j.Checksum, ChecksumCRC32C)
+	assert.Equal(t, j.Sum, sum)
+	pbBuf, err := h.MarshalPb()
+	assert.Equal(t, nil, err)
+	pb := &HllPb{}
+	assert.Equal(t, proto.Unmarshal(pbBuf, pb), nil)
+	assert.Equal(t, pb.GetChecksumType(), uint32(ChecksumCRC32C))
+	assert.Equal(t, pb.GetChecksum(), sum)
+}
+
+func TestChecksumCorrupt(t *testing.T) {
+	sparse, err := New(WithP(10), WithChecksum(ChecksumXXHash64))
+	assert.Equal(t, nil, err)
+	for i := 0; i < 10; i++ {
+		sparse.AddUint64Value(uint64(i))
+	}
+	dense := sparse.Copy()
+	dense.switchToNormal()
+
+	for _, h := range []*Hll{sparse, dense} {
+		buf, err := h.MarshalBinary()
+		assert.Equal(t, nil, err)
+		// Flip a bit in the last byte of the sparse list or the registers, which decodes to a
+		// valid sketch of the wrong cardinality if the checksum isn't checked.
+		buf[len(buf)-1] ^= 0x04
+		rt := &Hll{}
+		err = rt.UnmarshalBinary(buf)
+		assert.Tf(t, errors.Is(err, ErrCorrupt), "%v", err)
+		assert.T(t, errors.Is(Verify(buf), ErrCorrupt))
+
+		// A different p.
+		buf[len(buf)-1] ^= 0x04
+		buf[2]++
+		assert.T(t, errors.Is(Verify(buf), ErrCorrupt))
+	}
+
+	jBuf, err := dense.MarshalJSON()
+	assert.Equal(t, nil, err)
+	j := jsonableHll{}
+	assert.Equal(t, json.Unmarshal(jBuf, &j), nil)
+	(*j.BigM)[100] ^= 0x10
+	jBuf, err = json.Marshal(&j)
+	assert.Equal(t, nil, err)
+	assert.T(t, errors.Is(Verify(jBuf), ErrCorrupt))
+
+	pbBuf, err := dense.MarshalPb()
+	assert.Equal(t, nil, err)
+	pb := &HllPb{}
+	assert.Equal(t, proto.Unmarshal(pbBuf, pb), nil)
+	pb.M[100] ^= 0x10
+	pbBuf, err = proto.Marshal(pb)
+	assert.Equal(t, nil, err)
+	assert.T(t, errors.Is(Verify(pbBuf), ErrCorrupt))
+
+	// Without a checksum, the damage isn't detected.
+	dense.checksum = ChecksumNone
+	buf, err := dense.MarshalBinary()
+	assert.Equal(t, nil, err)
+	buf[len(buf)-1] ^= 0x04
+	assert.Equal(t, Verify(buf), nil)
+}
+
+func TestChecksumErrors(t *testing.T) {
+	_, err := New(WithChecksum(numChecksums))
+	assert.T(t, errors.Is(err, ErrInvalidChecksum))
+
+	h, err := New(WithP(10), WithChecksum(ChecksumCRC32C))
+	assert.Equal(t, nil, err)
+	h.switchToNormal()
+	buf, err := h.MarshalBinary()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, buf[4], byte(ChecksumCRC32C))
+
+	testCases := [][]byte{
+		append([]byte{binaryVersion, binaryFlagDense | binaryFlagChecksum, 10, 25, 9}, buf[5:]...),
+		append([]byte{binaryVersion, binaryFlagDense | binaryFlagChecksum, 10, 25, 0}, buf[5:]...),
+		buf[:5],
+		[]byte(`{"p":10,"pp":25,"s":{"B":"AA==","L":0,"N":0},"ct":9,"cs":1}`),
+		[]byte(`{"p":10,"pp":25,"s":{"B":"AA==","L":0,"N":0},"cs":1}`),
+		{0x08, 10, 0x10, 25, 0x22, 4, 0x10, 0, 0x18, 0, 0x38, 0x80, 0x02}, // A checksum type of 256
+	}
+	for i, buf := range testCases {
+		err := Verify(buf)
+		assert.Tf(t, errors.Is(err, ErrInvalidEncoding), "Testcase %d: %v", i, err)
+	}
+}
@@ -0,0 +1,166 @@
+package hll
+
+// The nibble that marks a register whose value is in the exception map of a compact.
+const auxToken = 15
+
+// compact is a layout of the dense registers with 4 bits per register (see WithCompactRegisters),
+// like the HLL_4 sketches of DataSketches. A register holds its offset from base, which is the
+// value of the smallest register. Few registers are ever more than 14 above the smallest one, so
+// those that are hold auxToken and keep their value in the aux map instead. Every value fits, one
+// way or the other, so the layout is lossless.
+//
+// The registers only grow in practice, so once no register is left at the base, the base is raised
+// to the new smallest value. That can happen at most 63 times.
+type compact struct {
+	nibbles   []byte           // register i is in the low nibble of byte i/2 when i is even
+	base      uint8            // the value of the smallest register
+	numAtBase uint64           // the number of registers whose value is base
+	aux       map[uint64]uint8 // the values of the registers that hold auxToken
+}
+
+func newCompact(numRegisters uint64) *compact {
+	return &compact{
+		nibbles:   make([]byte, (numRegisters+1)/2),
+		numAtBase: numRegisters,
+	}
+}
+
+// Returns the compact copy of the first numRegisters packed registers of n.
+func compactFrom(n normal, numRegisters uint64) *compact {
+	c := newCompact(numRegisters)
+	c.base = 0xff
+	for i := uint64(0); i < numRegisters; i++ {
+		c.base = minU8(c.base, n.Get(i))
+	}
+	c.numAtBase = 0
+	for i := uint64(0); i < numRegisters; i++ {
+		val := n.Get(i)
+		c.put(i, val)
+		if val == c.base {
+			c.numAtBase++
+		}
+	}
+	return c
+}
+
+func (c *compact) numRegisters() uint64 {
+	return uint64(len(c.nibbles)) * 2
+}
+
+func (c *compact) nibble(registerIdx uint64) uint8 {
+	return c.nibbles[registerIdx/2] >> (registerIdx % 2 * 4) & 0x0f
+}
+
+func (c *compact) setNibble(registerIdx uint64, nib uint8) {
+	shift := registerIdx % 2 * 4
+	b := &c.nibbles[registerIdx/2]
+	*b = *b&^(0x0f<<shift) | nib<<shift
+}
+
+func (c *compact) Get(registerIdx uint64) uint8 {
+	nib := c.nibble(registerIdx)
+	if nib == auxToken {
+		return c.aux[registerIdx]
+	}
+	return c.base + nib
+}
+
+func (c *compact) Set(registerIdx uint64, val uint8) {
+	if val < c.base {
+		c.rebase(val)
+	}
+	old := c.Get(registerIdx)
+	c.put(registerIdx, val)
+	if val == old {
+		return
+	}
+	if val == c.base {
+		c.numAtBase++
+	} else if old == c.base {
+		c.numAtBase--
+		if c.numAtBase == 0 {
+			c.rebase(c.min())
+		}
+	}
+}
+
+// Stores val, which must be at least base, in register registerIdx. The count of registers at the
+// base isn't updated.
+func (c *compact) put(registerIdx uint64, val uint8) {
+	if val-c.base >= auxToken {
+		c.setNibble(registerIdx, auxToken)
+		if c.aux == nil {
+			c.aux = make(map[uint64]uint8)
+		}
+		c.aux[registerIdx] = val
+		return
+	}
+	if c.nibble(registerIdx) == auxToken {
+		delete(c.aux, registerIdx)
+	}
+	c.setNibble(registerIdx, val-c.base)
+}
+
+// Returns the value of the smallest register.
+func (c *compact) min() uint8 {
+	smallest := uint8(0xff)
+	for i := uint64(0); i < c.numRegisters(); i++ {
+		smallest = minU8(smallest, c.Get(i))
+	}
+	return smallest
+}
+
+// Re-encodes all of the registers relative to the new base, which must not be larger than the
+// smallest register.
+func (c *compact) rebase(base uint8) {
+	oldBase := c.base
+	c.base = base
+	c.numAtBase = 0
+	for i := uint64(0); i < c.numRegisters(); i++ {
+		val := oldBase + c.nibble(i)
+		if c.nibble(i) == auxToken {
+			val = c.aux[i]
+		}
+		c.put(i, val)
+		if val == base {
+			c.numAtBase++
+		}
+	}
+}
+
+func (c *compact) clone() registers {
+	cp := &compact{
+		nibbles:   make([]byte, len(c.nibbles)),
+		base:      c.base,
+		numAtBase: c.numAtBase,
+	}
+	copy(cp.nibbles, c.nibbles)
+	if len(c.aux) > 0 {
+		cp.aux = make(map[uint64]uint8, len(c.aux))
+		for i, val := range c.aux {
+			cp.aux[i] = val
+		}
+	}
+	return cp
+}
+
+func (c *compact) histogram(numRegisters uint64) *registerHist {
+	hist := &registerHist{}
+	for i := uint64(0); i < numRegisters; i++ {
+		hist[c.Get(i)]++
+	}
+	return hist
+}
+
+// The registers of two compacts may have different bases, so they're merged one at a time.
+func (c *compact) maxMerge(other registers, numRegisters uint64, hist *registerHist) {
+	maxMergeRegisters(c, other, numRegisters, hist)
+}
+
+func (c *compact) packed(numRegisters uint64) normal {
+	n := newNormal(numRegisters)
+	for i := uint64(0); i < numRegisters; i++ {
+		n.Set(i, c.Get(i))
+	}
+	return n
+}
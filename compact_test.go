@@ -0,0 +1,76 @@
+package hll
+
+import (
+	mrand "math/rand"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// Checks that the base, the count of registers at the base and the exception map agree with the
+// registers.
+func checkCompact(t *testing.T, c *compact, expected unpacked) {
+	smallest, atBase := uint8(0xff), uint64(0)
+	for i, val := range expected {
+		assert.Equalf(t, c.Get(uint64(i)), val, "register %d", i)
+		smallest = minU8(smallest, val)
+	}
+	for _, val := range expected {
+		if val == smallest {
+			atBase++
+		}
+	}
+	assert.Equal(t, c.base, smallest)
+	assert.Equal(t, c.numAtBase, atBase)
+	for i := range expected {
+		_, inAux := c.aux[uint64(i)]
+		assert.Equalf(t, inAux, c.nibble(uint64(i)) == auxToken, "register %d", i)
+		assert.Equalf(t, inAux, expected[i]-smallest >= auxToken, "register %d", i)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	const numRegisters = 1 << 8
+	c, expected := newCompact(numRegisters), newUnpacked(numRegisters)
+	checkCompact(t, c, expected)
+
+	// Registers only grow when values are added, so the base rises.
+	for j := 0; j < 10000; j++ {
+		i := uint64(mrand.Intn(numRegisters))
+		val := maxU8(expected[i], uint8(mrand.Intn(30)))
+		c.Set(i, val)
+		expected.Set(i, val)
+	}
+	checkCompact(t, c, expected)
+	assert.T(t, c.base > 0)
+
+	// Setting a register below the base lowers the base, and may move registers to the exception
+	// map.
+	c.Set(7, 0)
+	expected.Set(7, 0)
+	checkCompact(t, c, expected)
+	assert.T(t, len(c.aux) > 0)
+
+	// The conversions to and from the packed layout are lossless.
+	n := c.packed(numRegisters)
+	for i := uint64(0); i < numRegisters; i++ {
+		assert.Equal(t, n.Get(i), expected[i])
+	}
+	checkCompact(t, compactFrom(n, numRegisters), expected)
+	assert.Equal(t, *c.histogram(numRegisters), *expected.histogram(numRegisters))
+
+	cp := c.clone().(*compact)
+	cp.Set(7, 63)
+	checkCompact(t, c, expected)
+	assert.Equal(t, cp.Get(7), uint8(63))
+}
+
+func TestCompactSize(t *testing.T) {
+	h, err := New(WithP(14), WithCompactRegisters())
+	assert.Equal(t, nil, err)
+	h.AddMany(randUint64s(t, 1000000))
+	c := h.bigM.(*compact)
+	// A third smaller than the packed layout, with only a few exceptions.
+	assert.Equal(t, len(c.nibbles)*3, len(newNormal(h.m))*2-2)
+	assert.Tf(t, uint64(len(c.aux)) < h.m/100, "%d exceptions, base %d", len(c.aux), c.base)
+}
@@ -0,0 +1,332 @@
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Apache DataSketches HLL sketches (https://datasketches.apache.org) are serialized with an 8-byte
+// preamble, in little-endian byte order:
+//
+//	0  preamble ints  2 in LIST mode, 3 in SET mode, 10 in HLL mode
+//	1  serial version 1
+//	2  family         7
+//	3  lgK            log2 of the number of registers
+//	4  lgArr          log2 of the size of the coupon array or the HLL_4 exception array
+//	5  flags          the dsFlag bits below
+//	6  list count     the number of coupons in LIST mode, or curMin in HLL mode
+//	7  mode           the current mode in bits 0-1, and the target HLL type in bits 2-3
+//
+// In LIST mode the coupons follow, and in SET mode a 4-byte count of the coupons and then the
+// coupons. A coupon is a 4-byte int whose top 6 bits are a register value, and whose low 26 bits
+// are an address whose low lgK bits are the register index. A compact image has only the coupons;
+// otherwise there are 2^lgArr slots, and the empty ones are zero.
+//
+// In HLL mode the preamble continues with the HIP estimate, kxq0 and kxq1 (8-byte floats), the
+// number of registers at curMin and the number of exceptions (4-byte ints), and then the registers.
+// HLL_8 has a byte per register. HLL_6 packs 6-bit registers from the least significant bit of each
+// byte, like Redis's dense encoding, and has an extra byte at the end. HLL_4 has a 4-bit nibble per
+// register, the even registers in the low nibbles, holding the register minus curMin. A nibble of
+// 15 means the register is in the exception array that follows, as a coupon of its index and
+// value.
+const (
+	dsSerVer     = 1
+	dsFamily     = 7
+	dsHeaderSize = 8
+	dsHllHeader  = 40
+
+	dsModeList = 0
+	dsModeSet  = 1
+	dsModeHll  = 2
+
+	dsCouponAddrBits = 26
+	dsAuxToken       = 15
+)
+
+const (
+	dsFlagEmpty      = 1 << 2
+	dsFlagCompact    = 1 << 3
+	dsFlagOutOfOrder = 1 << 4
+)
+
+// DataSketchesType is the type of the registers of an Apache DataSketches HLL sketch: HLL_4, HLL_6
+// or HLL_8.
+type DataSketchesType uint8
+
+const (
+	DataSketchesHLL4 DataSketchesType = iota
+	DataSketchesHLL6
+	DataSketchesHLL8
+)
+
+func (t DataSketchesType) String() string {
+	switch t {
+	case DataSketchesHLL4:
+		return "HLL_4"
+	case DataSketchesHLL6:
+		return "HLL_6"
+	case DataSketchesHLL8:
+		return "HLL_8"
+	}
+	return fmt.Sprintf("DataSketchesType(%d)", uint8(t))
+}
+
+// ErrInvalidDataSketches is matched (using errors.Is) by the errors returned when
+// UnmarshalDataSketches is given a buffer that isn't a DataSketches HLL sketch, or one with an lgK
+// that an Hll can't have.
+var ErrInvalidDataSketches = errors.New("hll: invalid DataSketches HLL sketch")
+
+// DataSketchesHasherName is the prefix of the HashID names of DataSketchesHasher. The name also
+// holds lgK, since it decides how the hash is rearranged.
+const DataSketchesHasherName = "datasketches-hll"
+
+// dsSeed is the seed of the hash function of DataSketches HLL sketches, which can't be changed.
+const dsSeed = 9001
+
+// DataSketchesHasher hashes inputs like the update methods of a DataSketches HLL sketch with
+// lgK=LgK do: with MurmurHash3 x64 128 and the seed 9001, as the UTF-8 bytes of a string or the 8
+// little-endian bytes of a long. DataSketches takes the register index from the low lgK bits of the
+// first 64 bits of the hash, and counts the leading zeros of the second 64 bits. Sum64 puts the
+// index at the top of the hash, and reverses the second half into the rest of it, so that an Hll
+// with p=lgK sets the same registers.
+//
+// Use it for sketches that will be combined with DataSketches sketches; see UnmarshalDataSketches.
+type DataSketchesHasher struct {
+	LgK uint
+}
+
+// Sum64 returns the rearranged hash of b.
+func (x DataSketchesHasher) Sum64(b []byte) uint64 {
+	h1, h2 := murmur3Sum128(b, dsSeed)
+	idx := h1 & (1<<x.LgK - 1)
+	return idx<<(64-x.LgK) | bits.Reverse64(h2)&(1<<(64-x.LgK)-1)
+}
+
+// HashID returns the HashID with the name DataSketchesHasherName/lgK=<LgK>.
+func (x DataSketchesHasher) HashID() HashID {
+	return HashID{dsHasherName(x.LgK), 0}
+}
+
+func dsHasherName(lgK uint) string {
+	return fmt.Sprintf("%s/lgK=%d", DataSketchesHasherName, lgK)
+}
+
+func init() {
+	for lgK := uint(minP); lgK <= maxP; lgK++ {
+		lgK := lgK
+		RegisterHasher(dsHasherName(lgK), func(uint64) Hasher { return DataSketchesHasher{lgK} })
+	}
+}
+
+// UnmarshalDataSketches replaces h with the DataSketches HLL sketch in buf, which is the output of
+// toCompactByteArray or toUpdatableByteArray, in any mode and of any type. The result is a dense
+// sketch with p=lgK, the default pPrime, and the HashID of DataSketchesHasher, so it can only be
+// combined with sketches that use DataSketchesHasher or whose hash function isn't known. Its
+// registers are those that the DataSketches sketch has in HLL mode, or would have after switching
+// to it. The HIP estimate and the other estimator state are ignored.
+//
+// It returns an error that wraps ErrInvalidDataSketches if buf isn't a valid sketch, or if lgK is
+// larger than 18.
+func (h *Hll) UnmarshalDataSketches(buf []byte) error {
+	if len(buf) < dsHeaderSize {
+		return fmt.Errorf("%w: %d bytes is too short for the preamble", ErrInvalidDataSketches,
+			len(buf))
+	}
+	preInts, serVer, family, lgK := buf[0], buf[1], buf[2], uint(buf[3])
+	lgArr, flags, mode := uint(buf[4]), buf[5], buf[7]
+	if serVer != dsSerVer || family != dsFamily {
+		return fmt.Errorf("%w: serial version %d and family %d", ErrInvalidDataSketches, serVer,
+			family)
+	}
+	if lgK < minP || lgK > maxP {
+		return fmt.Errorf("%w: lgK=%d is outside of [%d,%d]", ErrInvalidDataSketches, lgK, minP,
+			maxP)
+	}
+	curMode, typ := mode&3, DataSketchesType(mode>>2&3)
+	if typ > DataSketchesHLL8 {
+		return fmt.Errorf("%w: unknown type %d", ErrInvalidDataSketches, typ)
+	}
+	if lgArr > dsCouponAddrBits {
+		return fmt.Errorf("%w: lgArr=%d", ErrInvalidDataSketches, lgArr)
+	}
+	compact := flags&dsFlagCompact != 0
+
+	decoded, err := New(WithP(lgK), WithHasher(DataSketchesHasher{lgK}))
+	if err != nil {
+		return err
+	}
+	decoded.switchToNormal()
+	setCoupons := func(coupons []byte, count int) {
+		for i := 0; i < count; i++ {
+			c := binary.LittleEndian.Uint32(coupons[4*i:])
+			if c != 0 {
+				decoded.maxRegister(uint64(c)&(decoded.m-1), uint8(c>>dsCouponAddrBits))
+			}
+		}
+	}
+
+	switch {
+	case curMode == dsModeList && preInts == 2:
+		count := int(buf[6])
+		if !compact {
+			count = 1 << lgArr
+		}
+		if flags&dsFlagEmpty != 0 {
+			count = 0
+		}
+		if len(buf) != dsHeaderSize+4*count {
+			return fmt.Errorf("%w: LIST of %d bytes, expected %d", ErrInvalidDataSketches,
+				len(buf), dsHeaderSize+4*count)
+		}
+		setCoupons(buf[dsHeaderSize:], count)
+	case curMode == dsModeSet && preInts == 3:
+		if len(buf) < dsHeaderSize+4 {
+			return fmt.Errorf("%w: truncated SET", ErrInvalidDataSketches)
+		}
+		count := int(binary.LittleEndian.Uint32(buf[dsHeaderSize:]))
+		if !compact {
+			count = 1 << lgArr
+		}
+		if count < 0 || len(buf) != dsHeaderSize+4+4*count {
+			return fmt.Errorf("%w: SET of %d bytes, expected %d", ErrInvalidDataSketches,
+				len(buf), dsHeaderSize+4+4*count)
+		}
+		setCoupons(buf[dsHeaderSize+4:], count)
+	case curMode == dsModeHll && preInts == dsHllHeader/4:
+		if err := decoded.readDataSketchesHll(buf, typ, lgArr, compact); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: mode %d with %d preamble ints", ErrInvalidDataSketches, curMode,
+			preInts)
+	}
+
+	*h = *decoded
+	return nil
+}
+
+// Reads the registers of an HLL mode image into the dense sketch h.
+func (h *Hll) readDataSketchesHll(buf []byte, typ DataSketchesType, lgArr uint, compact bool) error {
+	size := dsHllHeader + dsRegistersSize(typ, h.m)
+	if len(buf) < size {
+		return fmt.Errorf("%w: %v registers of %d bytes, expected %d", ErrInvalidDataSketches, typ,
+			len(buf)-dsHllHeader, size-dsHllHeader)
+	}
+	regs := buf[dsHllHeader:size]
+	switch typ {
+	case DataSketchesHLL8:
+		for i, val := range regs {
+			if val > 63 {
+				return fmt.Errorf("%w: register %d is %d", ErrInvalidDataSketches, i, val)
+			}
+			h.maxRegister(uint64(i), val)
+		}
+	case DataSketchesHLL6:
+		for i := uint64(0); i < h.m; i++ {
+			h.maxRegister(i, getRedisRegister(regs, i))
+		}
+	case DataSketchesHLL4:
+		curMin := buf[6]
+		if curMin > 63-dsAuxToken {
+			return fmt.Errorf("%w: curMin=%d", ErrInvalidDataSketches, curMin)
+		}
+		numAux := int(binary.LittleEndian.Uint32(buf[36:]))
+		if !compact {
+			numAux = 1 << lgArr
+		}
+		aux := buf[size:]
+		if numAux < 0 || len(aux) != 4*numAux {
+			return fmt.Errorf("%w: %d bytes of exceptions, expected %d", ErrInvalidDataSketches,
+				len(aux), 4*numAux)
+		}
+		for i := uint64(0); i < h.m; i++ {
+			if nibble := regs[i/2] >> (4 * (i % 2)) & 0xf; nibble != dsAuxToken {
+				h.maxRegister(i, curMin+nibble)
+			}
+		}
+		for i := 0; i < numAux; i++ {
+			c := binary.LittleEndian.Uint32(aux[4*i:])
+			if c == 0 {
+				continue
+			}
+			idx := uint64(c) & (1<<dsCouponAddrBits - 1)
+			if idx >= h.m || regs[idx/2]>>(4*(idx%2))&0xf != dsAuxToken {
+				return fmt.Errorf("%w: exception for register %d, which doesn't have one",
+					ErrInvalidDataSketches, idx)
+			}
+			h.maxRegister(idx, uint8(c>>dsCouponAddrBits))
+		}
+		return nil
+	}
+	if len(buf) != size {
+		return fmt.Errorf("%w: %d bytes after the registers", ErrInvalidDataSketches,
+			len(buf)-size)
+	}
+	return nil
+}
+
+// Returns the size of the registers of an HLL mode image of the type.
+func dsRegistersSize(typ DataSketchesType, m uint64) int {
+	switch typ {
+	case DataSketchesHLL4:
+		return int(m / 2)
+	case DataSketchesHLL6:
+		return int(m*3/4 + 1)
+	default:
+		return int(m)
+	}
+}
+
+// MarshalDataSketches returns h as a compact DataSketches HLL sketch in HLL mode, with lgK=p and
+// registers of the given type, which must be DataSketchesHLL6 or DataSketchesHLL8. Since an Hll
+// doesn't keep a HIP estimate, the sketch is marked as out of order, so DataSketches estimates its
+// cardinality from the registers; the HIP field holds h's estimate. h isn't modified.
+//
+// A sparse sketch sets the same registers that DataSketches would, except for any that its sparse
+// list dropped, but it doesn't keep the bits that DataSketches counts the zeros of for most
+// hashes. Those registers are exported as 1, the least that DataSketches could have set, so the
+// result is never larger than DataSketches' sketch of the same values.
+//
+// h must use DataSketchesHasher with LgK=p or an unknown hash function, otherwise a
+// *HashMismatchError is returned.
+func (h *Hll) MarshalDataSketches(typ DataSketchesType) ([]byte, error) {
+	if typ != DataSketchesHLL6 && typ != DataSketchesHLL8 {
+		return nil, fmt.Errorf("%w: can't marshal %v", ErrInvalidDataSketches, typ)
+	}
+	if err := checkHashIDs(h.hashID, DataSketchesHasher{h.p}.HashID()); err != nil {
+		return nil, err
+	}
+	regs := h.exportRegisters()
+
+	buf := make([]byte, dsHllHeader+dsRegistersSize(typ, h.m))
+	buf[0], buf[1], buf[2], buf[3] = dsHllHeader/4, dsSerVer, dsFamily, byte(h.p)
+	buf[5] = dsFlagCompact | dsFlagOutOfOrder
+	buf[7] = dsModeHll | byte(typ)<<2
+
+	var kxq0, kxq1 float64
+	var numZeros uint32
+	for i := uint64(0); i < h.m; i++ {
+		val := regs.Get(i)
+		if val == 0 {
+			numZeros++
+		}
+		if val < 32 {
+			kxq0 += 1 / float64(uint64(1)<<val)
+		} else {
+			kxq1 += 1 / float64(uint64(1)<<val)
+		}
+		if typ == DataSketchesHLL8 {
+			buf[dsHllHeader+i] = val
+		} else {
+			setRedisRegister(buf[dsHllHeader:], i, val)
+		}
+	}
+	binary.LittleEndian.PutUint64(buf[8:], math.Float64bits(float64(h.readOnlyCardinality())))
+	binary.LittleEndian.PutUint64(buf[16:], math.Float64bits(kxq0))
+	binary.LittleEndian.PutUint64(buf[24:], math.Float64bits(kxq1))
+	binary.LittleEndian.PutUint32(buf[32:], numZeros)
+	return buf, nil
+}
@@ -0,0 +1,177 @@
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/bits"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestDataSketchesHasher(t *testing.T) {
+	// The first and second halves of MurmurHash3 x64 128 with the seed 9001.
+	testCases := []struct {
+		input  string
+		h1, h2 uint64
+	}{
+		{"", 0x1e70a32266491bb9, 0x609736b252406b94},
+		{"hello", 0x21b77bd4a835c1aa, 0xc3001500fe032ef2},
+	}
+	for i, testCase := range testCases {
+		h1, h2 := murmur3Sum128([]byte(testCase.input), dsSeed)
+		assert.Equalf(t, h1, testCase.h1, "Testcase %d: %#x", i, h1)
+		assert.Equalf(t, h2, testCase.h2, "Testcase %d: %#x", i, h2)
+
+		// The register index is the low lgK bits of h1, and rho counts the leading zeros of h2.
+		x := DataSketchesHasher{LgK: 11}.Sum64([]byte(testCase.input))
+		assert.Equal(t, x>>53, testCase.h1&0x7ff)
+		assert.Equal(t, rho(x), uint8(bits.LeadingZeros64(testCase.h2)+1))
+	}
+}
+
+// The fixtures are compact images of sketches with lgK=11 of the strings "elem:0" to
+// "elem:<count-1>".
+var dataSketchesFixtures = []struct {
+	file  string
+	count int
+	mode  byte
+	typ   DataSketchesType
+}{
+	{"testdata/datasketches-list.bin", 5, dsModeList, DataSketchesHLL8},
+	{"testdata/datasketches-set.bin", 100, dsModeSet, DataSketchesHLL6},
+	{"testdata/datasketches-hll4.bin", 20000, dsModeHll, DataSketchesHLL4},
+	{"testdata/datasketches-hll6.bin", 20000, dsModeHll, DataSketchesHLL6},
+	{"testdata/datasketches-hll8.bin", 20000, dsModeHll, DataSketchesHLL8},
+}
+
+func TestUnmarshalDataSketches(t *testing.T) {
+	for _, fixture := range dataSketchesFixtures {
+		buf, err := ioutil.ReadFile(fixture.file)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, buf[7], fixture.mode|byte(fixture.typ)<<2)
+
+		h := &Hll{}
+		assert.Equal(t, h.UnmarshalDataSketches(buf), nil)
+		expected, err := New(WithP(11), WithHasher(DataSketchesHasher{LgK: 11}))
+		assert.Equal(t, nil, err)
+		expected.switchToNormal()
+		for i := 0; i < fixture.count; i++ {
+			expected.AddString(fmt.Sprintf("elem:%d", i))
+		}
+		assert.Equalf(t, h.bigM, expected.bigM, "%s", fixture.file)
+		assert.Equal(t, *h.hist, *expected.hist)
+		assert.Equal(t, h.HashID(), DataSketchesHasher{LgK: 11}.HashID())
+
+		card := float64(h.Cardinality())
+		assert.Tf(t, card >= 0.9*float64(fixture.count) && card <= 1.1*float64(fixture.count),
+			"%s: cardinality %v", fixture.file, card)
+
+		// The registers of an HLL_6 or HLL_8 sketch are written back as they were, with the same
+		// estimator state, but without the HIP estimate.
+		if fixture.mode == dsModeHll && fixture.typ != DataSketchesHLL4 {
+			exported, err := h.MarshalDataSketches(fixture.typ)
+			assert.Equal(t, nil, err)
+			assert.Equalf(t, exported[:5], buf[:5], "%s", fixture.file)
+			assert.Equal(t, exported[5], byte(dsFlagCompact|dsFlagOutOfOrder))
+			assert.Equal(t, exported[6:8], buf[6:8])
+			assert.Equal(t, exported[16:], buf[16:])
+		}
+		for _, typ := range []DataSketchesType{DataSketchesHLL6, DataSketchesHLL8} {
+			exported, err := h.MarshalDataSketches(typ)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, math.Float64frombits(binary.LittleEndian.Uint64(exported[8:])), card)
+			rt := &Hll{}
+			assert.Equal(t, rt.UnmarshalDataSketches(exported), nil)
+			assert.Equalf(t, rt.bigM, h.bigM, "%s as %v", fixture.file, typ)
+		}
+	}
+}
+
+func TestMarshalDataSketches(t *testing.T) {
+	// A sketch that's still sparse sets the registers that DataSketches sets in the fixture of the
+	// same strings, and never to larger values.
+	fixture := dataSketchesFixtures[1]
+	fixtureBuf, err := ioutil.ReadFile(fixture.file)
+	assert.Equal(t, nil, err)
+	ds := &Hll{}
+	assert.Equal(t, ds.UnmarshalDataSketches(fixtureBuf), nil)
+	h, err := New(WithP(11), WithHasher(DataSketchesHasher{LgK: 11}))
+	assert.Equal(t, nil, err)
+	for i := 0; i < fixture.count; i++ {
+		h.AddString(fmt.Sprintf("elem:%d", i))
+	}
+	assert.T(t, h.isSparse && len(h.tempSet) > 0)
+	tempSet := len(h.tempSet)
+	card := h.Copy().Cardinality()
+
+	buf, err := h.MarshalDataSketches(DataSketchesHLL8)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(buf), dsHllHeader+2048)
+	assert.Equal(t, len(h.tempSet), tempSet)
+	assert.Equal(t, math.Float64frombits(binary.LittleEndian.Uint64(buf[8:])), float64(card))
+	rt := &Hll{}
+	assert.Equal(t, rt.UnmarshalDataSketches(buf), nil)
+	set := 0
+	for i := uint64(0); i < rt.m; i++ {
+		val, dsVal := rt.bigM.Get(i), ds.bigM.Get(i)
+		assert.Tf(t, val <= dsVal, "register %d is %d, DataSketches has %d", i, val, dsVal)
+		if val != 0 {
+			set++
+		}
+	}
+	assert.Tf(t, set > fixture.count*9/10, "%d registers set", set)
+
+	// Merged into the fixture's registers, it leaves them unchanged.
+	merged := ds.Copy()
+	assert.Equal(t, merged.CombineE(rt), nil)
+	assert.Equal(t, merged.bigM, ds.bigM)
+
+	_, err = h.MarshalDataSketches(DataSketchesHLL4)
+	assert.T(t, errors.Is(err, ErrInvalidDataSketches))
+	h, err = New(WithP(12), WithHasher(DataSketchesHasher{LgK: 11}))
+	assert.Equal(t, nil, err)
+	_, err = h.MarshalDataSketches(DataSketchesHLL8)
+	assert.T(t, errors.Is(err, ErrHashMismatch))
+}
+
+func TestUnmarshalDataSketchesErrors(t *testing.T) {
+	hll8, err := ioutil.ReadFile("testdata/datasketches-hll8.bin")
+	assert.Equal(t, nil, err)
+	hll4, err := ioutil.ReadFile("testdata/datasketches-hll4.bin")
+	assert.Equal(t, nil, err)
+	with := func(buf []byte, i int, b byte) []byte {
+		buf = append([]byte{}, buf...)
+		buf[i] = b
+		return buf
+	}
+	testCases := [][]byte{
+		nil,
+		hll8[:7],
+		with(hll8, 1, 2),    // Serial version
+		with(hll8, 2, 3),    // Family
+		with(hll8, 3, 19),   // lgK
+		with(hll8, 7, 0x0e), // Unknown type
+		with(hll8, 0, 3),    // Preamble ints of a SET in HLL mode
+		with(hll8, 100, 64), // Register too large
+		hll8[:len(hll8)-1],
+		append(hll8, 0),
+		hll4[:len(hll4)-1],
+		with(hll4, 65, 0), // Register 50 has an exception, but not a nibble of 15
+		{2, 1, 7, 11, 3, dsFlagCompact, 2, dsModeList, 1, 0, 0, 0},
+	}
+	for i, buf := range testCases {
+		h := &Hll{}
+		err := h.UnmarshalDataSketches(buf)
+		assert.Tf(t, errors.Is(err, ErrInvalidDataSketches), "Testcase %d: %v", i, err)
+	}
+
+	// An empty sketch is a LIST with no coupons.
+	h := &Hll{}
+	assert.Equal(t, h.UnmarshalDataSketches([]byte{2, 1, 7, 11, 3, dsFlagEmpty | dsFlagCompact, 0,
+		dsModeList | byte(DataSketchesHLL4)<<2}), nil)
+	assert.Equal(t, h.Cardinality(), uint64(0))
+}
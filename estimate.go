@@ -0,0 +1,101 @@
+package hll
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// DefaultConfidence is the confidence level of the bounds returned by Hll.Estimate.
+const DefaultConfidence = 0.95
+
+// ErrInvalidConfidence is returned when a confidence level isn't strictly between 0 and 1.
+var ErrInvalidConfidence = errors.New("hll: confidence must be strictly between 0 and 1")
+
+// Estimate is a cardinality estimate along with its standard error and a confidence interval.
+type Estimate struct {
+	Cardinality uint64  // The point estimate, the same as Cardinality() returns.
+	StdErr      float64 // The standard error of the estimate, in unique inputs.
+
+	// Lower and Upper bound the confidence interval. The true cardinality is in [Lower, Upper]
+	// with a probability of roughly Confidence.
+	Lower, Upper uint64
+	Confidence   float64
+
+	Regime Regime // The estimator that produced Cardinality.
+}
+
+// Estimate returns the cardinality estimate along with its standard error and bounds at the
+// DefaultConfidence level. Like Cardinality, it merges the temp set into the sparse list first.
+func (h *Hll) Estimate() Estimate {
+	est, _ := h.EstimateAt(DefaultConfidence)
+	return est
+}
+
+// EstimateAt is like Estimate, but the bounds are at the given confidence level, which must be
+// strictly between 0 and 1.
+//
+// The standard error depends on the estimator that's used. Linear counting over m buckets has a
+// standard error of sqrt(m(e^t-t-1)) where t=n/m, from "A Linear-Time Probabilistic Counting
+// Algorithm for Database Applications" by Whang, Vander-Zanden and Taylor. The HyperLogLog
+// estimates have a relative standard error of 1.04/sqrt(2^p). The bounds assume that the error is
+// normally distributed.
+//
+// In the sparse case, Cardinality uses linear counting over the 2^p' sparse buckets. But the sparse
+// list only keeps one hash per index, so inputs that share one of the 2^p indexes are counted once
+// and the estimate is biased low. The lower bound comes from linear counting over the 2^p'
+// buckets, and the upper bound from linear counting over the 2^p indexes, which accounts for the
+// inputs that share an index. StdErr combines the standard errors of both. If the sparse list has
+// every one of the 2^p indexes, linear counting over them has no bound, so the upper bound comes from
+// the HyperLogLog estimate of the registers that the sketch would have when dense instead.
+func (h *Hll) EstimateAt(confidence float64) (Estimate, error) {
+	if !(confidence > 0 && confidence < 1) {
+		return Estimate{}, fmt.Errorf("%w: got %v", ErrInvalidConfidence, confidence)
+	}
+
+	// See Cardinality() for why this is needed.
+	h.mergeTmpSetIfAny()
+
+	est := Estimate{Confidence: confidence}
+	// The number of standard deviations that covers the confidence level of a normal distribution.
+	z := math.Sqrt2 * math.Erfinv(confidence)
+
+	if h.isSparse {
+		est.Cardinality, est.Regime = h.cardinalityLC(), RegimeSparse
+		sparseStdErr := linearCountingStdErr(h.mPrime, est.Cardinality)
+
+		var indexCard uint64
+		var indexStdErr float64
+		if numIndexes := h.sparseList.GetNumElements(); numIndexes < h.m {
+			indexCard = linearCounting(h.m, h.m-numIndexes)
+			indexStdErr = linearCountingStdErr(h.m, indexCard)
+		} else {
+			dense := h.Copy()
+			dense.switchToNormal()
+			indexCard, _ = dense.estimateNormal()
+			indexStdErr = 1.04 / math.Sqrt(float64(h.m)) * float64(indexCard)
+		}
+
+		est.StdErr = math.Sqrt(sparseStdErr*sparseStdErr + indexStdErr*indexStdErr)
+		est.Lower = roundFloatToUint64(math.Max(0, float64(est.Cardinality)-z*sparseStdErr))
+		est.Upper = roundFloatToUint64(float64(maxU64(indexCard, est.Cardinality)) +
+			z*indexStdErr)
+		return est, nil
+	}
+
+	est.Cardinality, est.Regime = h.estimateNormal()
+	if est.Regime == RegimeLinearCounting {
+		est.StdErr = linearCountingStdErr(h.m, est.Cardinality)
+	} else {
+		est.StdErr = 1.04 / math.Sqrt(float64(h.m)) * float64(est.Cardinality)
+	}
+	est.Lower = roundFloatToUint64(math.Max(0, float64(est.Cardinality)-z*est.StdErr))
+	est.Upper = roundFloatToUint64(float64(est.Cardinality) + z*est.StdErr)
+	return est, nil
+}
+
+// Returns the standard error of a linear counting estimate of n over m buckets.
+func linearCountingStdErr(m, n uint64) float64 {
+	t := float64(n) / float64(m)
+	return math.Sqrt(float64(m) * (math.Expm1(t) - t))
+}
@@ -0,0 +1,100 @@
+package hll
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestEstimate(t *testing.T) {
+	testCases := []struct {
+		p      uint
+		count  int
+		dense  bool
+		regime Regime
+	}{
+		{14, 100, false, RegimeSparse},
+		{14, 1000, false, RegimeSparse},
+		{12, 1000, true, RegimeLinearCounting},
+		{12, 5000, true, RegimeBiasCorrected},
+		{12, 100000, true, RegimeRaw},
+	}
+
+	const trials = 20
+	for i, testCase := range testCases {
+		misses := 0
+		for trial := 0; trial < trials; trial++ {
+			h := NewHll(testCase.p, 25)
+			if testCase.dense {
+				h.switchToNormal()
+			}
+			for _, x := range randUint64s(t, testCase.count) {
+				h.Add(x)
+			}
+
+			est := h.Estimate()
+			assert.Equalf(t, est.Cardinality, h.Cardinality(), "Testcase %d", i)
+			assert.Equalf(t, est.Regime, testCase.regime, "Testcase %d: regime %v", i, est.Regime)
+			assert.Equal(t, est.Confidence, DefaultConfidence)
+			assert.Tf(t, est.StdErr > 0, "Testcase %d: standard error %v", i, est.StdErr)
+			assert.Tf(t, est.Lower <= est.Cardinality && est.Cardinality <= est.Upper,
+				"Testcase %d: %d is not in [%d, %d]", i, est.Cardinality, est.Lower, est.Upper)
+
+			if uint64(testCase.count) < est.Lower || uint64(testCase.count) > est.Upper {
+				misses++
+			}
+		}
+		// The bounds should cover the true cardinality roughly 95% of the time.
+		assert.Tf(t, misses <= 4, "Testcase %d: %d/%d trials outside the bounds", i, misses, trials)
+	}
+}
+
+func TestEstimateAt(t *testing.T) {
+	h := NewHll(12, 25)
+	for _, x := range randUint64s(t, 100000) {
+		h.Add(x)
+	}
+
+	narrow, err := h.EstimateAt(0.5)
+	assert.Equal(t, nil, err)
+	wide, err := h.EstimateAt(0.999)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, narrow.Cardinality, wide.Cardinality)
+	assert.Equal(t, narrow.StdErr, wide.StdErr)
+	assert.T(t, wide.Lower < narrow.Lower && narrow.Upper < wide.Upper)
+
+	for _, confidence := range []float64{0, 1, -0.5, 1.5, math.NaN()} {
+		_, err := h.EstimateAt(confidence)
+		assert.Tf(t, errors.Is(err, ErrInvalidConfidence), "confidence %v: %v", confidence, err)
+	}
+
+	// An empty sketch has tight bounds around 0.
+	est := NewHll(12, 25).Estimate()
+	assert.Equal(t, est.Cardinality, uint64(0))
+	assert.Equal(t, est.Lower, uint64(0))
+	assert.Equal(t, est.Upper, uint64(0))
+
+	// A sparse list that has every index still has a finite upper bound.
+	h, err = New(WithP(4), WithPPrime(25), WithSparseThresholdBits(1<<20))
+	assert.Equal(t, nil, err)
+	for _, x := range randUint64s(t, 300) {
+		h.Add(x)
+	}
+	est, err = h.EstimateAt(0.95)
+	assert.Equal(t, nil, err)
+	assert.T(t, h.isSparse)
+	assert.Equal(t, h.sparseList.GetNumElements(), h.m)
+	assert.Tf(t, !math.IsInf(est.StdErr, 0) && !math.IsNaN(est.StdErr), "standard error %v",
+		est.StdErr)
+	assert.Tf(t, est.Lower <= est.Cardinality && est.Cardinality <= est.Upper && est.Upper < 3000,
+		"%+v", est)
+}
+
+func TestLinearCountingStdErr(t *testing.T) {
+	// For t=n/m much smaller than 1, the standard error is roughly n/sqrt(2m).
+	stdErr := linearCountingStdErr(1<<25, 1000)
+	assert.Tf(t, math.Abs(stdErr-1000/math.Sqrt(2<<25)) < 0.01, "%v", stdErr)
+	assert.Equal(t, linearCountingStdErr(1<<12, 0), 0.0)
+}
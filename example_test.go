@@ -39,3 +39,16 @@ func Example() {
 	fmt.Printf("%d\n", hll.Cardinality())
 	// Output: 989546
 }
+
+func ExampleHll_AddString() {
+	hll := NewHll(14, 25)
+
+	// AddString hashes its input, so there's no need to bring your own hash function.
+	for i := 0; i < 1000000; i++ {
+		hll.AddString(strconv.Itoa(i))
+	}
+	hll.AddString("1") // Duplicates do not affect the cardinality.
+
+	fmt.Printf("%d\n", hll.Cardinality())
+	// Output: 987664
+}
@@ -0,0 +1,172 @@
+package hll
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Each decoder is fuzzed with untrusted input. Decoding may fail, but it mustn't panic, and a sketch
+// that it accepts must be usable.
+
+// Returns sketches to encode as the seed corpus: empty, sparse, dense, and sparse with a checksum.
+func fuzzSeedSketches() []*Hll {
+	empty := NewHll(14, 25)
+	sparse := NewHll(14, 25)
+	dense := NewHll(14, 25)
+	checksummed, _ := New(WithChecksum(ChecksumCRC32C))
+	for i := uint64(0); i < 5000; i++ {
+		if i < 100 {
+			sparse.AddUint64Value(i)
+			checksummed.AddUint64Value(i)
+		}
+		dense.AddUint64Value(i)
+	}
+	return []*Hll{empty, sparse, dense, checksummed}
+}
+
+// Adds the files in testdata matching pattern to the corpus of f.
+func addTestdata(f *testing.F, pattern string) {
+	files, err := filepath.Glob(filepath.Join("testdata", pattern))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf)
+	}
+}
+
+// Exercises a sketch that was decoded without an error.
+func checkDecoded(t *testing.T, h *Hll) {
+	h.Cardinality()
+	buf, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary of a decoded sketch: %v", err)
+	}
+	rt := &Hll{}
+	if err := rt.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("UnmarshalBinary of a re-encoded sketch: %v", err)
+	}
+	if rt.Cardinality() != h.Cardinality() {
+		t.Fatalf("Cardinality changed from %d to %d when re-encoded", h.Cardinality(),
+			rt.Cardinality())
+	}
+
+	// The set operations build registers from the sparse list without going through toNormal.
+	if _, err := IntersectionCardinality(h, h.Copy()); err != nil {
+		t.Fatalf("IntersectionCardinality with a copy: %v", err)
+	}
+	if _, err := EstimateSimilarity(h, h.Copy()); err != nil {
+		t.Fatalf("EstimateSimilarity with a copy: %v", err)
+	}
+
+	other := h.Copy()
+	for i := uint64(0); i < 100; i++ {
+		h.Add(i * 0x9e3779b97f4a7c15)
+	}
+	if err := h.CombineE(other); err != nil {
+		t.Fatalf("CombineE with a copy: %v", err)
+	}
+	h.Cardinality()
+}
+
+func FuzzUnmarshalBinary(f *testing.F) {
+	for _, h := range fuzzSeedSketches() {
+		buf, _ := h.MarshalBinary()
+		f.Add(buf)
+		buf, _ = h.MarshalBinaryCompressed()
+		f.Add(buf)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		h := &Hll{}
+		if h.UnmarshalBinary(buf) == nil {
+			checkDecoded(t, h)
+		}
+	})
+}
+
+func FuzzUnmarshalJSON(f *testing.F) {
+	for _, h := range fuzzSeedSketches() {
+		buf, _ := h.MarshalJSON()
+		f.Add(buf)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		h := &Hll{}
+		if h.UnmarshalJSON(buf) == nil {
+			checkDecoded(t, h)
+		}
+	})
+}
+
+func FuzzUnmarshalPb(f *testing.F) {
+	for _, h := range fuzzSeedSketches() {
+		buf, _ := h.MarshalPb()
+		f.Add(buf)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		h := &Hll{}
+		if h.UnmarshalPb(buf) == nil {
+			checkDecoded(t, h)
+		}
+	})
+}
+
+func FuzzGobDecode(f *testing.F) {
+	for _, h := range fuzzSeedSketches() {
+		buf, _ := h.GobEncode()
+		f.Add(buf)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		h := &Hll{}
+		if h.GobDecode(buf) == nil {
+			checkDecoded(t, h)
+		}
+	})
+}
+
+func FuzzUnmarshalRedis(f *testing.F) {
+	addTestdata(f, "redis-*")
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		h := &Hll{}
+		if h.UnmarshalRedis(buf) == nil {
+			checkDecoded(t, h)
+		}
+	})
+}
+
+func FuzzUnmarshalPostgres(f *testing.F) {
+	addTestdata(f, "postgres-*")
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		h := &Hll{}
+		if h.UnmarshalPostgres(buf) == nil {
+			checkDecoded(t, h)
+		}
+	})
+}
+
+func FuzzImportZetaSketch(f *testing.F) {
+	for _, h := range fuzzSeedSketches() {
+		buf, _ := h.ExportZetaSketch()
+		f.Add(buf)
+	}
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		h := &Hll{}
+		if h.ImportZetaSketch(buf) == nil {
+			checkDecoded(t, h)
+		}
+	})
+}
+
+func FuzzUnmarshalDataSketches(f *testing.F) {
+	addTestdata(f, "datasketches-*")
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		h := &Hll{}
+		if h.UnmarshalDataSketches(buf) == nil {
+			checkDecoded(t, h)
+		}
+	})
+}
@@ -0,0 +1,279 @@
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sync"
+)
+
+// Hasher hashes inputs to the 64-bit values that Add expects. The bits of the hash should be
+// uniformly distributed: the sketch takes its register index from the top bits and rho from the
+// rest.
+type Hasher interface {
+	Sum64(b []byte) uint64
+}
+
+// HasherFunc adapts an ordinary function to the Hasher interface.
+type HasherFunc func(b []byte) uint64
+
+// Sum64 returns f(b).
+func (f HasherFunc) Sum64(b []byte) uint64 {
+	return f(b)
+}
+
+// HashID identifies the hash function and seed that produced the hashes in a sketch. Sketches whose
+// hashes came from different functions can't be combined: the result would be silently wrong.
+//
+// The zero HashID means that the hash function isn't known, for example because the sketch was
+// only given hashes through Add, or because it was marshaled before hash IDs were recorded. A
+// sketch with an unknown hash function can be combined with any other sketch.
+type HashID struct {
+	Name string
+	Seed uint64
+}
+
+// IsZero reports whether id is the zero HashID, meaning that the hash function isn't known.
+func (id HashID) IsZero() bool {
+	return id == HashID{}
+}
+
+func (id HashID) String() string {
+	if id.IsZero() {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s(seed=%d)", id.Name, id.Seed)
+}
+
+// IdentifiedHasher is a Hasher that knows its own HashID. A sketch records the HashID of an
+// IdentifiedHasher, and refuses to be combined with sketches built with a different one.
+type IdentifiedHasher interface {
+	Hasher
+	HashID() HashID
+}
+
+// XXHash64Name is the HashID name of XXHash64.
+const XXHash64Name = "xxhash64"
+
+// XXHash64 is the 64-bit variant of xxHash (https://github.com/Cyan4973/xxHash) with the given
+// seed. The zero value is xxHash64 with a seed of 0, which is the default hasher of an Hll.
+type XXHash64 struct {
+	Seed uint64
+}
+
+// Sum64 returns the xxHash64 of b.
+func (x XXHash64) Sum64(b []byte) uint64 {
+	return xxhash64(b, x.Seed)
+}
+
+// HashID returns the HashID with the name XXHash64Name and x's seed.
+func (x XXHash64) HashID() HashID {
+	return HashID{XXHash64Name, x.Seed}
+}
+
+var (
+	hasherRegistryMu sync.RWMutex
+	hasherRegistry   = map[string]func(seed uint64) Hasher{
+		XXHash64Name:    func(seed uint64) Hasher { return XXHash64{seed} },
+		RedisHasherName: func(uint64) Hasher { return RedisHasher{} },
+	}
+)
+
+// RegisterHasher makes a hash function available by name, so that an unmarshaled sketch can find
+// the Hasher that matches its HashID. newHasher returns the Hasher for a seed. XXHash64,
+// RedisHasher, PostgresHasher and DataSketchesHasher are registered by default.
+//
+// Like other registries, RegisterHasher is meant to be called from init functions. It panics if
+// name is empty or is already registered.
+func RegisterHasher(name string, newHasher func(seed uint64) Hasher) {
+	hasherRegistryMu.Lock()
+	defer hasherRegistryMu.Unlock()
+	if name == "" {
+		panic("hll: RegisterHasher with an empty name")
+	}
+	if _, ok := hasherRegistry[name]; ok {
+		panic("hll: RegisterHasher called twice for " + name)
+	}
+	hasherRegistry[name] = newHasher
+}
+
+// Returns the registered Hasher for id, or nil if there isn't one.
+func lookupHasher(id HashID) Hasher {
+	hasherRegistryMu.RLock()
+	newHasher, ok := hasherRegistry[id.Name]
+	hasherRegistryMu.RUnlock()
+	if !ok {
+		return nil
+	}
+	return newHasher(id.Seed)
+}
+
+// Returns the HashID of hasher, or the zero HashID if it doesn't identify itself.
+func hasherID(hasher Hasher) HashID {
+	if identified, ok := hasher.(IdentifiedHasher); ok {
+		return identified.HashID()
+	}
+	return HashID{}
+}
+
+// ErrHashMismatch is matched (using errors.Is) by the errors returned when two sketches that were
+// built with different hash functions are combined.
+var ErrHashMismatch = errors.New("hll: hash function mismatch")
+
+// HashMismatchError describes an attempt to combine sketches built with different hash functions.
+type HashMismatchError struct {
+	ID      HashID // The hash function of the sketch being combined into.
+	OtherID HashID // The hash function of the other sketch.
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("Hash function mismatch: %v/%v", e.ID, e.OtherID)
+}
+
+// Is makes errors.Is(err, ErrHashMismatch) true for a *HashMismatchError.
+func (e *HashMismatchError) Is(target error) bool {
+	return target == ErrHashMismatch
+}
+
+// Returns a *HashMismatchError unless the hash IDs are equal, or one of them is unknown.
+func checkHashIDs(id, otherID HashID) error {
+	if id.IsZero() || otherID.IsZero() || id == otherID {
+		return nil
+	}
+	return &HashMismatchError{id, otherID}
+}
+
+// HashID returns the identity of the hash function that produced h's hashes, or the zero HashID if
+// it isn't known.
+func (h *Hll) HashID() HashID {
+	return h.hashID
+}
+
+// SetHasher sets the Hasher used by AddBytes, AddString and AddUint64Value, for example on a sketch
+// that was unmarshaled and whose hash function isn't registered with RegisterHasher. It returns a
+// *HashMismatchError if hasher identifies itself as a different hash function than the one h
+// already records.
+func (h *Hll) SetHasher(hasher Hasher) error {
+	id := hasherID(hasher)
+	if err := checkHashIDs(h.hashID, id); err != nil {
+		return err
+	}
+	if h.hashID.IsZero() {
+		h.hashID = id
+	}
+	h.hasher = hasher
+	return nil
+}
+
+// AddBytes hashes b with the sketch's Hasher and adds the hash. The first time it's called, the
+// sketch records the HashID of the Hasher if it doesn't have one yet.
+//
+// AddBytes panics if the sketch records a HashID that isn't registered (see RegisterHasher) and
+// no Hasher has been set with SetHasher.
+func (h *Hll) AddBytes(b []byte) {
+	h.Add(h.getHasher().Sum64(b))
+}
+
+// AddString hashes s with the sketch's Hasher and adds the hash.
+func (h *Hll) AddString(s string) {
+	h.AddBytes([]byte(s))
+}
+
+// AddUint64Value hashes the 8 little-endian bytes of v with the sketch's Hasher and adds the hash.
+// Use this for values such as IDs or counters, which aren't uniformly distributed. Add expects v to
+// be a hash already.
+func (h *Hll) AddUint64Value(v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	h.AddBytes(buf[:])
+}
+
+// Returns the hasher set by WithHasher or SetHasher. Otherwise it's the registered hasher for the
+// recorded HashID, or the default hasher if there's no HashID. The hasher's ID is recorded if h
+// doesn't have one yet.
+func (h *Hll) getHasher() Hasher {
+	if h.hasher == nil {
+		if h.hashID.IsZero() {
+			h.hasher = XXHash64{}
+		} else if h.hasher = lookupHasher(h.hashID); h.hasher == nil {
+			panic(fmt.Sprintf("hll: no hasher is registered for %v", h.hashID))
+		}
+	}
+	if h.hashID.IsZero() {
+		h.hashID = hasherID(h.hasher)
+	}
+	return h.hasher
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// The xxHash64 algorithm, from the specification at
+// https://github.com/Cyan4973/xxHash/blob/dev/doc/xxhash_spec.md
+func xxhash64(b []byte, seed uint64) uint64 {
+	n := len(b)
+	var h uint64
+
+	if n >= 32 {
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+		for len(b) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(b[0:8]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:16]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:24]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:32]))
+			b = b[32:]
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) +
+			bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = seed + xxPrime5
+	}
+
+	h += uint64(n)
+
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b[:8]))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b[:4])) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	val = xxRound(0, val)
+	acc ^= val
+	return acc*xxPrime1 + xxPrime4
+}
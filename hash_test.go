@@ -0,0 +1,264 @@
+package hll
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestXXHash64(t *testing.T) {
+	testCases := []struct {
+		input    string
+		seed     uint64
+		expected uint64
+	}{
+		{"", 0, 0xef46db3751d8e999},
+		{"a", 0, 0xd24ec4f1a98c6e5b},
+		{"abc", 0, 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0, 0xfbcea83c8a378bf1},
+		{"", 1, 0xd5afba1336a3be4b},
+	}
+
+	for i, testCase := range testCases {
+		actual := XXHash64{testCase.seed}.Sum64([]byte(testCase.input))
+		assert.Equalf(t, actual, testCase.expected, "Testcase %d: %x", i, actual)
+	}
+}
+
+// Every input length exercises a different mix of the 32-byte stripes and the 8, 4 and 1-byte tails,
+// so check that changing any byte changes the hash.
+func TestXXHash64Lengths(t *testing.T) {
+	for n := 0; n < 100; n++ {
+		b := []byte(strings.Repeat("x", n))
+		seen := map[uint64]bool{xxhash64(b, 0): true}
+		for i := range b {
+			b[i] = 'y'
+			sum := xxhash64(b, 0)
+			assert.Tf(t, !seen[sum], "length %d: collision changing byte %d", n, i)
+			seen[sum] = true
+			b[i] = 'x'
+		}
+	}
+}
+
+func TestAddHashed(t *testing.T) {
+	h := NewHll(14, 25)
+	expected := NewHll(14, 25)
+
+	h.AddString("hello")
+	expected.Add(XXHash64{}.Sum64([]byte("hello")))
+	h.AddBytes([]byte("world"))
+	expected.Add(XXHash64{}.Sum64([]byte("world")))
+	h.AddUint64Value(12345)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], 12345)
+	expected.Add(XXHash64{}.Sum64(buf[:]))
+
+	assert.Equal(t, h.tempSet, expected.tempSet)
+}
+
+func TestWithHasher(t *testing.T) {
+	var calls int
+	hasher := HasherFunc(func(b []byte) uint64 {
+		calls++
+		return xxhash64(b, 42)
+	})
+
+	h, err := New(WithHasher(hasher))
+	assert.Equal(t, nil, err)
+	for i := 0; i < 1000; i++ {
+		h.AddUint64Value(uint64(i))
+	}
+	assert.Equal(t, calls, 1000)
+
+	// Copies and the results of Reduce and UnionAll keep the hasher.
+	h.Copy().AddString("a")
+	assert.Equal(t, calls, 1001)
+	reduced, err := h.Reduce(12, 20)
+	assert.Equal(t, nil, err)
+	reduced.AddString("a")
+	assert.Equal(t, calls, 1002)
+	union, err := UnionAll(h, h.Copy())
+	assert.Equal(t, nil, err)
+	union.AddString("a")
+	assert.Equal(t, calls, 1003)
+
+	// Sequential values are spread out by the hash, so the estimate should be close.
+	card := float64(h.Cardinality())
+	assert.Tf(t, card > 950 && card < 1050, "cardinality %v", card)
+}
+
+func TestHashIDRecorded(t *testing.T) {
+	// Sketches that are only given hashes don't know their hash function.
+	h := NewHll(14, 25)
+	h.Add(randUint64(t))
+	assert.T(t, h.HashID().IsZero())
+
+	// The default hasher is recorded when it's first used.
+	h.AddString("a")
+	assert.Equal(t, h.HashID(), HashID{XXHash64Name, 0})
+
+	h, err := New(WithHasher(XXHash64{7}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, h.HashID(), HashID{XXHash64Name, 7})
+
+	h, err = New(WithHashID(HashID{"sha1", 0}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, h.HashID(), HashID{"sha1", 0})
+	assert.Equal(t, h.Copy().HashID(), HashID{"sha1", 0})
+
+	_, err = New(WithHasher(XXHash64{7}), WithHashID(HashID{"sha1", 0}))
+	assert.T(t, errors.Is(err, ErrHashMismatch))
+}
+
+func TestHashMismatch(t *testing.T) {
+	newSketch := func(seed uint64) *Hll {
+		h, err := New(WithP(12), WithHasher(XXHash64{seed}))
+		assert.Equal(t, nil, err)
+		for i := 0; i < 100; i++ {
+			h.AddUint64Value(uint64(i))
+		}
+		return h
+	}
+	a, b := newSketch(1), newSketch(2)
+
+	err := a.Copy().CombineE(b)
+	assert.T(t, errors.Is(err, ErrHashMismatch))
+	assert.Equal(t, err.Error(), "Hash function mismatch: xxhash64(seed=1)/xxhash64(seed=2)")
+	assert.T(t, errors.Is(a.CombineReadOnly(b), ErrHashMismatch))
+	_, err = Union(a, b)
+	assert.T(t, errors.Is(err, ErrHashMismatch))
+	_, err = UnionAll(a, a.Copy(), b)
+	assert.T(t, errors.Is(err, ErrHashMismatch))
+	_, err = EstimateJoint(a, b)
+	assert.T(t, errors.Is(err, ErrHashMismatch))
+	assert.T(t, errors.Is(a.CombineReduce(b), ErrHashMismatch))
+
+	defer func() {
+		assert.T(t, recover() != nil)
+	}()
+	a.Combine(b)
+}
+
+// A sketch with an unknown hash function can be combined with anything, and the union takes on the
+// known hash function.
+func TestHashIDUnknown(t *testing.T) {
+	known := NewHll(12, 25)
+	known.AddString("a")
+	unknown := NewHll(12, 25)
+	unknown.Add(randUint64(t))
+
+	assert.Equal(t, unknown.Copy().CombineE(known), nil)
+	union, err := Union(unknown, known)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, union.HashID(), known.HashID())
+
+	// UnionAll checks all of the known hash functions against each other, not only the first.
+	union, err = UnionAll(unknown, known, unknown)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, union.HashID(), known.HashID())
+	other, err := New(WithP(12), WithHasher(XXHash64{1}))
+	assert.Equal(t, nil, err)
+	_, err = UnionAll(unknown, known, other)
+	assert.T(t, errors.Is(err, ErrHashMismatch))
+}
+
+func TestHashIDRoundTrip(t *testing.T) {
+	h, err := New(WithP(12), WithHasher(XXHash64{99}))
+	assert.Equal(t, nil, err)
+	for i := 0; i < 10000; i++ {
+		h.AddUint64Value(uint64(i))
+		if i != 10 && i != 9999 {
+			continue
+		}
+
+		jBuf, err := json.Marshal(h)
+		assert.Equal(t, nil, err)
+		fromJSON := &Hll{}
+		assert.Equal(t, json.Unmarshal(jBuf, fromJSON), nil)
+
+		pbBuf, err := h.MarshalPb()
+		assert.Equal(t, nil, err)
+		fromPb := &Hll{}
+		assert.Equal(t, fromPb.UnmarshalPb(pbBuf), nil)
+
+		var gobBuf bytes.Buffer
+		assert.Equal(t, gob.NewEncoder(&gobBuf).Encode(h), nil)
+		fromGob := &Hll{}
+		assert.Equal(t, gob.NewDecoder(&gobBuf).Decode(fromGob), nil)
+
+		for _, rt := range []*Hll{fromJSON, fromPb, fromGob} {
+			assert.Equal(t, rt.HashID(), HashID{XXHash64Name, 99})
+			// The hasher is found in the registry, so adding the same input has no effect.
+			card := rt.Cardinality()
+			rt.AddUint64Value(0)
+			assert.Equal(t, rt.Cardinality(), card)
+		}
+	}
+
+	// Sketches without a hash function still round trip without one.
+	h = NewHll(12, 25)
+	pbBuf, err := h.MarshalPb()
+	assert.Equal(t, nil, err)
+	rt := &Hll{}
+	assert.Equal(t, rt.UnmarshalPb(pbBuf), nil)
+	assert.T(t, rt.HashID().IsZero())
+}
+
+type testHasher struct{}
+
+// RegisterHasher panics if it's called twice, so only register testHasher once per test binary.
+var registerTestHasher sync.Once
+
+func (testHasher) Sum64(b []byte) uint64 {
+	return xxhash64(b, 12345)
+}
+
+func (testHasher) HashID() HashID {
+	return HashID{"test", 0}
+}
+
+func TestRegisterHasher(t *testing.T) {
+	h, err := New(WithHasher(testHasher{}))
+	assert.Equal(t, nil, err)
+	h.AddString("a")
+	buf, err := json.Marshal(h)
+	assert.Equal(t, nil, err)
+
+	// An unmarshaled sketch can't hash if its hash function isn't registered and no hasher is set.
+	rt := &Hll{}
+	assert.Equal(t, json.Unmarshal(buf, rt), nil)
+	rt.hashID = HashID{"unregistered", 0}
+	func() {
+		defer func() {
+			assert.T(t, recover() != nil)
+		}()
+		rt.AddString("a")
+	}()
+	rt.hashID = HashID{"test", 0}
+
+	assert.T(t, errors.Is(rt.SetHasher(XXHash64{}), ErrHashMismatch))
+	assert.Equal(t, rt.SetHasher(testHasher{}), nil)
+	rt.AddString("a")
+	assert.Equal(t, rt.Cardinality(), uint64(1))
+
+	registerTestHasher.Do(func() {
+		RegisterHasher("test", func(uint64) Hasher { return testHasher{} })
+	})
+	rt = &Hll{}
+	assert.Equal(t, json.Unmarshal(buf, rt), nil)
+	rt.AddString("a")
+	assert.Equal(t, rt.Cardinality(), uint64(1))
+
+	defer func() {
+		assert.T(t, recover() != nil)
+	}()
+	RegisterHasher(XXHash64Name, func(seed uint64) Hasher { return XXHash64{seed} })
+}
@@ -2,9 +2,11 @@ package hll
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"sort"
+	"sync"
 
 	"github.com/gogo/protobuf/proto"
 )
@@ -26,22 +28,39 @@ func init() {
 }
 
 type Hll struct {
-	bigM                normal   // M is used for the dense case, and registers the rho values for each hashed index.
-	sparseList          *sparse  // This will be nil if isSparse==false. Used for sparse case for aggregation
-	tempSet             []uint64 // used to store values temporarilty for the sparse case
-	alpha               float64  // constant used in cardinality calculation
-	isSparse            bool     // boolean flag that determines when to switch over to the dense case
-	p, pPrime           uint     // precision bits for dense and sparse cases
-	m, mPrime           uint64   // register sizes for dense and sparse cases
-	mergeSizeBits       uint64   // the limit for the size of the temp set
-	sparseThresholdBits uint64   // the limit for the size of the sparseList, indicates when to switch to dense.
+	bigM                registers      // M is used for the dense case, and registers the rho values for each hashed index.
+	hist                *registerHist  // the number of registers in bigM with each value, nil in the sparse case
+	sparseList          *sparse        // This will be nil if isSparse==false. Used for sparse case for aggregation
+	tempSet             []uint64       // used to store values temporarilty for the sparse case
+	alpha               float64        // constant used in cardinality calculation
+	isSparse            bool           // boolean flag that determines when to switch over to the dense case
+	p, pPrime           uint           // precision bits for dense and sparse cases
+	m, mPrime           uint64         // register sizes for dense and sparse cases
+	mergeSizeBits       uint64         // the limit for the size of the temp set
+	sparseThresholdBits uint64         // the limit for the size of the sparseList, indicates when to switch to dense.
+	hasher              Hasher         // used by AddBytes and friends, nil means the default hasher
+	hashID              HashID         // the hash function of the inputs, zero if unknown
+	spareBuf            []byte         // a buffer for the next merge of the temp set, see mergeTmpSetIfAny
+	sorter              uint64Sorter   // for sorting the temp set without allocating
+	layout              registerLayout // the type of bigM
+	checksum            Checksum       // the checksum embedded when marshaling
 }
 
 func (h *Hll) Copy() *Hll {
 	tempset := make([]uint64, len(h.tempSet))
 	copy(tempset, h.tempSet)
+	var hist *registerHist
+	if h.hist != nil {
+		hist = &registerHist{}
+		*hist = *h.hist
+	}
+	var bigM registers
+	if h.bigM != nil {
+		bigM = h.bigM.clone()
+	}
 	return &Hll{
-		bigM:                h.bigM.Copy(),
+		bigM:                bigM,
+		hist:                hist,
 		sparseList:          h.sparseList.Copy(),
 		tempSet:             tempset,
 		alpha:               h.alpha,
@@ -52,21 +71,43 @@ func (h *Hll) Copy() *Hll {
 		mPrime:              h.mPrime,
 		mergeSizeBits:       h.mergeSizeBits,
 		sparseThresholdBits: h.sparseThresholdBits,
+		hasher:              h.hasher,
+		hashID:              h.hashID,
+		layout:              h.layout,
+		checksum:            h.checksum,
 	}
 }
 
 // Initialize a new hyper-log-log struct based on inputs p and p'.
 // Google recommends that p be set to 14, and p' to equal either 20 or 25.
+//
+// NewHll panics if the parameters are invalid. Use New to get an error instead.
 func NewHll(p, pPrime uint) *Hll {
-	if p < 4 || p > 18 {
-		panic("p must be in the range [4,18]")
+	h, err := New(WithP(p), WithPPrime(pPrime))
+	if err != nil {
+		panic(err.Error())
+	}
+	return h
+}
+
+// New creates a hyper-log-log struct configured by the given options. Without options, p is 14
+// and p' is 25. The returned error wraps ErrInvalidP, ErrInvalidPPrime or ErrInvalidThreshold if
+// the options don't describe a usable sketch, ErrHashMismatch if WithHashID and WithHasher
+// disagree, or ErrInvalidChecksum if WithChecksum is given an unknown checksum.
+func New(opts ...Option) (*Hll, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
 	}
 
 	h := &Hll{}
-	h.p = p
-	h.pPrime = pPrime
+	h.p = o.p
+	h.pPrime = o.pPrime
 	h.m = 1 << h.p
-	h.mPrime = 1 << pPrime
+	h.mPrime = 1 << h.pPrime
 	h.isSparse = true
 
 	switch h.m {
@@ -82,15 +123,14 @@ func NewHll(p, pPrime uint) *Hll {
 
 	h.sparseList = newSparse(0)
 	h.tempSet = []uint64{}
-
-	// The sparse threshold (the threshold for when to convert to the normal case) is set to m.6 bits.
-	h.sparseThresholdBits = h.m * 6
-
-	// When the temp set reaches 25% of the maximum size for sparse register storage, merge the
-	// temp set with the sparse list.
-	h.mergeSizeBits = h.sparseThresholdBits / 4
-
-	return h
+	h.sparseThresholdBits = o.sparseThresholdBits
+	h.mergeSizeBits = o.mergeSizeBits
+	h.hasher = o.hasher
+	h.hashID = o.hashID
+	h.layout = o.layout
+	h.checksum = o.checksum
+
+	return h, nil
 }
 
 // Add takes a hash and updates the cardinality estimation data structures.
@@ -106,25 +146,124 @@ func (h *Hll) Add(x uint64) {
 	}
 }
 
+// AddMany is like calling Add for each of the hashes in xs, but faster. In the sparse case the whole
+// batch is encoded, sorted once and merged into the sparse list in a single pass, instead of being
+// merged a temp set at a time. If the batch alone would make the sparse list larger than the sparse
+// threshold, the sketch switches to the dense representation before adding it.
+func (h *Hll) AddMany(xs []uint64) {
+	// Every encoded hash takes at least one byte in the sparse list.
+	if h.isSparse && uint64(len(xs))*8 > h.sparseThresholdBits {
+		h.mergeTmpSetIfAny()
+		if h.isSparse {
+			h.switchToNormal()
+		}
+	}
+
+	if !h.isSparse {
+		for _, x := range xs {
+			h.addNormal(x)
+		}
+		return
+	}
+
+	for _, x := range xs {
+		h.tempSet = append(h.tempSet, encodeHash(x, h.p, h.pPrime))
+	}
+	h.mergeTmpSetIfAny()
+}
+
 // Combine() merges two HyperLogLog++ calculations. This allows you to parallelize cardinality
 // estimation: each thread can process a shard of the input, then the results can be merged later to
 // give the cardinality of the entire data set (the union of the shards).
 //
 // WARNING: The "other" parameter may be mutated during this call! It may be converted from a sparse
 // to dense representation, which may affect its space usage and precision. This is a deliberate
-// design decision that helps to minimize memory consumption.
+// design decision that helps to minimize memory consumption. Use CombineReadOnly or Union if other
+// must not change.
 //
-// The inputs must have the same p and pPrime or this function will panic.
+// The inputs must have the same p and pPrime, and must not record different hash functions (see
+// HashID), or this function will panic. Use CombineE to get an error instead.
 // The Google paper doesn't give an algorithm for this operation, but its existence is implied, and
 // the ability to do this combine operation is one of the main benefits of using a HyperLogLog-type
 // algorithm in the first place.
 func (h *Hll) Combine(other *Hll) {
-	if h.p != other.p || h.pPrime != other.pPrime {
-		panic(fmt.Sprintf("Parameter mismatch: p=%d/%d, pPrime=%d/%d", h.p, other.p, h.pPrime,
-			other.pPrime))
+	if err := h.CombineE(other); err != nil {
+		panic(err.Error())
+	}
+}
+
+// ErrPrecisionMismatch is matched (using errors.Is) by the errors returned when two sketches with
+// different p or pPrime are combined.
+var ErrPrecisionMismatch = errors.New("hll: precision mismatch")
+
+// PrecisionMismatchError describes an attempt to combine sketches with different parameters.
+type PrecisionMismatchError struct {
+	P, PPrime           uint // The parameters of the sketch being combined into.
+	OtherP, OtherPPrime uint // The parameters of the other sketch.
+}
+
+func (e *PrecisionMismatchError) Error() string {
+	return fmt.Sprintf("Parameter mismatch: p=%d/%d, pPrime=%d/%d", e.P, e.OtherP, e.PPrime,
+		e.OtherPPrime)
+}
+
+// Is makes errors.Is(err, ErrPrecisionMismatch) true for a *PrecisionMismatchError.
+func (e *PrecisionMismatchError) Is(target error) bool {
+	return target == ErrPrecisionMismatch
+}
+
+// CombineE is like Combine, but returns a *PrecisionMismatchError instead of panicking if the
+// inputs have different p or pPrime, or a *HashMismatchError if they record different hash
+// functions. Neither input is changed when an error is returned.
+func (h *Hll) CombineE(other *Hll) error {
+	if err := h.checkCombinable(other); err != nil {
+		return err
 	}
 
 	other.mergeTmpSetIfAny()
+	h.combine(other, other.sparseList)
+	return nil
+}
+
+// CombineReadOnly is like CombineE, but never modifies other. Other's temp set is read without
+// being merged into its sparse list, so other can be shared between goroutines that combine it into
+// different sketches at the same time, as long as nothing is adding to it.
+func (h *Hll) CombineReadOnly(other *Hll) error {
+	if err := h.checkCombinable(other); err != nil {
+		return err
+	}
+
+	h.combine(other, other.readOnlySparse())
+	return nil
+}
+
+// Union returns a new Hll estimating the cardinality of the union of a's and b's inputs. Neither
+// input is modified. It returns a *PrecisionMismatchError if a and b have different p or pPrime,
+// or a *HashMismatchError if they record different hash functions.
+func Union(a, b *Hll) (*Hll, error) {
+	if err := a.checkCombinable(b); err != nil {
+		return nil, err
+	}
+
+	union := a.Copy()
+	union.combine(b, b.readOnlySparse())
+	return union, nil
+}
+
+func (h *Hll) checkCombinable(other *Hll) error {
+	if h.p != other.p || h.pPrime != other.pPrime {
+		return &PrecisionMismatchError{h.p, h.pPrime, other.p, other.pPrime}
+	}
+	return checkHashIDs(h.hashID, other.hashID)
+}
+
+// Merges other into h. If other is sparse, otherSparse must hold all of its encoded hashes (its
+// temp set included); otherwise it's ignored.
+func (h *Hll) combine(other *Hll, otherSparse *sparse) {
+	// The union holds other's hashes, so it has other's hash function if h didn't know its own.
+	if h.hashID.IsZero() {
+		h.hashID = other.hashID
+	}
 
 	// If the other Hll is normal (not sparse), then the union will be normal. If this Hll isn't
 	// also normal, do the conversion now.
@@ -133,25 +272,23 @@ func (h *Hll) Combine(other *Hll) {
 	}
 
 	if h.isSparse && other.isSparse { // Case 1: both inputs are sparse
-		capBytes := maxU64(h.sparseList.SizeInBytes(), other.sparseList.SizeInBytes())
+		capBytes := maxU64(h.sparseList.SizeInBytes(), otherSparse.SizeInBytes())
 		h.sparseList = merge(h.p, h.pPrime, capBytes, h.sparseList.GetIterator(),
-			other.sparseList.GetIterator())
+			otherSparse.GetIterator())
 		if h.sparseList.SizeInBits() > h.sparseThresholdBits {
 			h.switchToNormal()
 		}
 	} else if !h.isSparse && !other.isSparse { // Case 2: both inputs are normal
-		for i := uint64(0); i < h.m; i++ {
-			h.bigM.Set(i, maxU8(h.bigM.Get(i), other.bigM.Get(i)))
-		}
+		h.bigM.maxMerge(other.bigM, h.m, h.hist)
 	} else { // Case 3: h is normal, other is sparse
-		otherIt := other.sparseList.GetIterator()
+		otherIt := otherSparse.GetIterator()
 		for {
 			hashCode, ok := otherIt()
 			if !ok {
 				break
 			}
 			index, r := decodeHash(hashCode, h.p, h.pPrime)
-			h.bigM.Set(index, maxU8(h.bigM.Get(index), r))
+			h.maxRegister(index, r)
 		}
 	}
 }
@@ -170,28 +307,69 @@ func (h *Hll) mergeTmpSetIfAny() {
 	if !h.isSparse || len(h.tempSet) == 0 {
 		return
 	}
-	sortHashcodesByIndex(h.tempSet, h.p, h.pPrime)
-	tmpSetIt := makeU64SliceIt(h.tempSet)
-	sparseIt := h.sparseList.GetIterator()
-	h.sparseList = merge(h.p, h.pPrime, h.sparseList.SizeInBytes(), sparseIt, tmpSetIt)
-	h.tempSet = []uint64{}
+	// Sorting through a pointer to a field, rather than a new sorter, avoids an allocation.
+	h.sorter = uint64Sorter{h.tempSet, h.p, h.pPrime}
+	sort.Sort(&h.sorter)
+	h.sorter.xs = nil
+
+	// The sparse list and the spare buffer take turns holding the merged list, and the temp set is
+	// reused, so that adding in the sparse case doesn't allocate once the buffers are large enough.
+	h.spareBuf = h.sparseList.mergeSorted(h.p, h.pPrime, h.tempSet, h.spareBuf)
+	h.tempSet = h.tempSet[:0]
 	if h.sparseList.SizeInBits() > h.sparseThresholdBits {
 		h.switchToNormal()
+		h.tempSet = []uint64{}
 	}
 }
 
+// Returns a sparse list holding the sparse list and the temp set of h, without modifying h. The
+// result is h.sparseList itself when the temp set is empty, so it must not be modified.
+func (h *Hll) readOnlySparse() *sparse {
+	if !h.isSparse || len(h.tempSet) == 0 {
+		return h.sparseList
+	}
+	tempSet := tempSetPool.Get().(*[]uint64)
+	*tempSet = append((*tempSet)[:0], h.tempSet...)
+	sortHashcodesByIndex(*tempSet, h.p, h.pPrime)
+	merged := merge(h.p, h.pPrime, h.sparseList.SizeInBytes(), h.sparseList.GetIterator(),
+		makeU64SliceIt(*tempSet))
+	tempSetPool.Put(tempSet)
+	return merged
+}
+
+// Scratch space for sorting copies of temp sets.
+var tempSetPool = sync.Pool{
+	New: func() interface{} {
+		return new([]uint64)
+	},
+}
+
 func (h *Hll) switchToNormal() {
 	h.isSparse = false
-	h.bigM = toNormal(h.sparseList, h.p, h.pPrime)
+	h.bigM = h.layout.fromPacked(toNormal(h.sparseList, h.p, h.pPrime), h.m)
+	h.hist = h.bigM.histogram(h.m)
 	h.sparseList = nil
+	h.spareBuf = nil
 }
 
 func (h *Hll) addNormal(x uint64) {
 	offset := (64 - h.p)
 	idx := x >> offset
 	r := rho(x)
-	if r > h.bigM.Get(idx) {
-		h.bigM.Set(idx, r)
+	h.maxRegister(idx, r)
+}
+
+// Sets the dense register idx to r if r is larger than its value, and keeps the histogram of the
+// register values up to date.
+func (h *Hll) maxRegister(idx uint64, r uint8) {
+	old := h.bigM.Get(idx)
+	if r <= old {
+		return
+	}
+	h.bigM.Set(idx, r)
+	if h.hist != nil {
+		h.hist[old]--
+		h.hist[r]++
 	}
 }
 
@@ -216,76 +394,136 @@ func (h *Hll) cardinalityLC() uint64 {
 
 // Returns the cardinality estimate for the dense case.
 func (h *Hll) cardinalityNormal() uint64 {
-	inverseSum := float64(0)
-	V := uint64(0)
+	card, _ := h.estimateNormal()
+	return card
+}
 
-	// calculate the harmonic mean of the values in the registers.
-	for i := uint64(0); i < h.m; i++ {
-		registerVal := h.bigM.Get(i)
-		inverseSum += 1 / lookupTable[registerVal]
-		if registerVal == 0 {
-			V++
-		}
+// Returns the cardinality estimate for the dense case, and the regime that produced it.
+//
+// The histogram of the register values is kept up to date as registers change, so this doesn't
+// have to scan the registers. An Hll that somehow lacks the histogram gets the same result from a
+// scan.
+func (h *Hll) estimateNormal() (uint64, Regime) {
+	hist := h.hist
+	if hist == nil {
+		hist = h.bigM.histogram(h.m)
 	}
+	// calculate the harmonic mean of the values in the registers.
+	inverseSum, V := hist.sums()
+	return h.estimateFromRegisterSums(inverseSum, V)
+}
+
+// Returns the dense cardinality estimate given the sum of 2^-M[i] over all registers and the number
+// of registers that are zero, and the regime that produced it.
+func (h *Hll) estimateFromRegisterSums(inverseSum float64, V uint64) (uint64, Regime) {
 	e1 := h.alpha * float64(h.m*h.m) / inverseSum
 	// Take bias into consideration
 	var e2 float64
+	var e2Regime Regime
 	if e1 <= 5*float64(h.m) {
 		e2 = e1 - h.estimateBias(e1)
+		e2Regime = RegimeBiasCorrected
 	} else {
 		e2 = e1
+		e2Regime = RegimeRaw
 	}
 	// if not all registers are filled, linear counting is more accurate than the bias-corrected raw estimate.
 	var H uint64
+	var hRegime Regime
 	if V != 0 {
 		H = linearCounting(h.m, V)
+		hRegime = RegimeLinearCounting
 	} else {
 		H = roundFloatToUint64(e2)
+		hRegime = e2Regime
 	}
 	if H <= uint64(thresholds[h.p]) { // extracts empirically determined threshold value
-		return H
+		return H, hRegime
 	} else {
-		return roundFloatToUint64(e2)
+		return roundFloatToUint64(e2), e2Regime
+	}
+}
+
+// Regime identifies the estimator that produced a cardinality estimate.
+type Regime int
+
+const (
+	// RegimeSparse is linear counting over the 2^pPrime buckets of the sparse representation.
+	RegimeSparse Regime = iota
+	// RegimeLinearCounting is linear counting over the 2^p registers of the dense representation.
+	RegimeLinearCounting
+	// RegimeBiasCorrected is the raw HyperLogLog estimate, corrected using the empirical bias data.
+	RegimeBiasCorrected
+	// RegimeRaw is the raw HyperLogLog estimate, used when it's too large to have a known bias.
+	RegimeRaw
+)
+
+func (r Regime) String() string {
+	switch r {
+	case RegimeSparse:
+		return "sparse"
+	case RegimeLinearCounting:
+		return "linear counting"
+	case RegimeBiasCorrected:
+		return "bias corrected"
+	case RegimeRaw:
+		return "raw"
 	}
+	return fmt.Sprintf("Regime(%d)", int(r))
 }
 
 // When marshalling an Hll to JSON, we only marshal a subset of its fields.
 type jsonableHll struct {
-	BigM       *normal `json:"M,omitempty"`
-	SparseList *sparse `json:"s,omitempty"`
-	P          uint    `json:"p"`
-	PPrime     uint    `json:"pp"`
+	BigM       *normal  `json:"M,omitempty"`
+	SparseList *sparse  `json:"s,omitempty"`
+	P          uint     `json:"p"`
+	PPrime     uint     `json:"pp"`
+	HashName   string   `json:"hn,omitempty"`
+	HashSeed   uint64   `json:"hs,omitempty"`
+	Checksum   Checksum `json:"ct,omitempty"`
+	Sum        uint64   `json:"cs,omitempty"`
 }
 
 func (h *Hll) MarshalJSON() ([]byte, error) {
 	// Combine tmpSet with sparse list. This saves serializing the tmpSet, which saves space.
 	h.mergeTmpSetIfAny()
 
-	bigM := &h.bigM
-	if len(*bigM) == 0 {
-		bigM = nil
+	// The registers are always marshaled in the packed layout.
+	var bigM *normal
+	var packed normal
+	if h.bigM != nil {
+		packed = h.bigM.packed(h.m)
+		bigM = &packed
 	}
 
-	return json.Marshal(&jsonableHll{bigM, h.sparseList, h.p, h.pPrime})
+	j := &jsonableHll{BigM: bigM, SparseList: h.sparseList, P: h.p, PPrime: h.pPrime,
+		HashName: h.hashID.Name, HashSeed: h.hashID.Seed, Checksum: h.checksum}
+	if h.checksum != ChecksumNone {
+		j.Sum = checksumOf(h.checksum, h.p, h.pPrime, h.hashID, packed, h.sparseList)
+	}
+	return json.Marshal(j)
 }
 
+// UnmarshalJSON replaces h with the sketch in buf, which was marshaled by MarshalJSON. It returns an
+// error that wraps ErrInvalidEncoding if buf isn't a valid sketch, or ErrCorrupt if buf doesn't
+// match its checksum.
 func (h *Hll) UnmarshalJSON(buf []byte) error {
 	j := jsonableHll{}
 
 	if err := json.Unmarshal(buf, &j); err != nil {
-		return err
+		return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
 	}
 
-	// Copy field values from the jsonable model to the real Hll struct.
-	*h = *NewHll(j.P, j.PPrime)
-	h.sparseList = nil
-	h.bigM = nil
-
-	h.sparseList = j.SparseList
+	var bigM normal
 	if j.BigM != nil {
-		h.bigM = *j.BigM
+		bigM = *j.BigM
+	}
+	decoded, err := newDecoded(j.P, j.PPrime, bigM, j.SparseList, HashID{j.HashName, j.HashSeed},
+		j.Checksum, j.Sum)
+	if err != nil {
+		return err
 	}
-	h.isSparse = (h.sparseList != nil)
+	*h = *decoded
 	return nil
 }
 
@@ -297,7 +535,9 @@ func (h *Hll) MarshalPb() ([]byte, error) {
 	pb := &HllPb{}
 	pb.P = &p
 	pb.Pp = &pp
-	pb.M = h.bigM
+	if h.bigM != nil {
+		pb.M = h.bigM.packed(h.m)
+	}
 	if h.sparseList != nil {
 		pb.S = &HllPbSparse{
 			Buf:         h.sparseList.buf,
@@ -305,42 +545,118 @@ func (h *Hll) MarshalPb() ([]byte, error) {
 			NumElements: &h.sparseList.numElements,
 		}
 	}
+	if !h.hashID.IsZero() {
+		pb.HashName = &h.hashID.Name
+		pb.HashSeed = &h.hashID.Seed
+	}
+	if h.checksum != ChecksumNone {
+		var packed normal
+		if h.bigM != nil {
+			packed = pb.M
+		}
+		checksumType := uint32(h.checksum)
+		sum := checksumOf(h.checksum, h.p, h.pPrime, h.hashID, packed, h.sparseList)
+		pb.ChecksumType = &checksumType
+		pb.Checksum = &sum
+	}
 
 	return proto.Marshal(pb)
 }
 
+// UnmarshalPb replaces h with the sketch in buf, which was marshaled by MarshalPb. It returns an
+// error that wraps ErrInvalidEncoding if buf isn't a valid sketch, or ErrCorrupt if buf doesn't
+// match its checksum.
 func (h *Hll) UnmarshalPb(buf []byte) error {
 	pb := &HllPb{}
 	err := proto.Unmarshal(buf, pb)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+	if pb.P == nil || pb.Pp == nil {
+		return fmt.Errorf("%w: p or pp is missing", ErrInvalidEncoding)
+	}
+	if *pb.P < 0 || *pb.Pp < 0 {
+		return fmt.Errorf("%w: p=%d, pp=%d", ErrInvalidEncoding, *pb.P, *pb.Pp)
 	}
 
 	// Copy field values from the protobuf omdel to the real Hll struct.
-	p, pp := uint(*pb.P), uint(*pb.Pp)
-
-	*h = *NewHll(p, pp)
-	h.sparseList = nil
-	h.bigM = nil
-
+	var sparseList *sparse
 	if pb.S != nil {
-		h.sparseList = &sparse{pb.S.Buf, *pb.S.LastVal, *pb.S.NumElements}
+		if pb.S.LastVal == nil || pb.S.NumElements == nil {
+			return fmt.Errorf("%w: the sparse list's lastVal or numElements is missing",
+				ErrInvalidEncoding)
+		}
+		sparseList = &sparse{pb.S.Buf, *pb.S.LastVal, *pb.S.NumElements}
 	}
-	if pb.M != nil {
-		h.bigM = pb.M
+	if pb.GetChecksumType() >= uint32(numChecksums) {
+		return fmt.Errorf("%w: unknown checksum type %d", ErrInvalidEncoding, pb.GetChecksumType())
 	}
-
-	h.isSparse = (h.sparseList != nil)
+	decoded, err := newDecoded(uint(*pb.P), uint(*pb.Pp), normal(pb.M), sparseList,
+		HashID{pb.GetHashName(), pb.GetHashSeed()}, Checksum(pb.GetChecksumType()),
+		pb.GetChecksum())
+	if err != nil {
+		return err
+	}
+	*h = *decoded
 	return nil
 }
 
-// custom gob encoder and decoders
+// Returns a sketch with the decoded parameters and representation, which is bigM if the sketch is
+// dense, and sparseList if it's sparse. It checks that there's exactly one of them, that it matches
+// the checksum sum of type c, and that it's valid for p and pPrime. It returns an error that wraps
+// ErrCorrupt if the checksum doesn't match, or ErrInvalidEncoding if the sketch isn't valid.
+// Unmarshaled sketches have the default sparse threshold and merge size, and the packed register
+// layout, and they embed the same type of checksum when they're marshaled again.
+func newDecoded(p, pPrime uint, bigM normal, sparseList *sparse, hashID HashID, c Checksum,
+	sum uint64) (*Hll, error) {
+	decoded, err := New(WithP(p), WithPPrime(pPrime))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+	if bigM != nil && sparseList != nil {
+		return nil, fmt.Errorf("%w: both dense registers and a sparse list", ErrInvalidEncoding)
+	}
+	if bigM == nil && sparseList == nil {
+		return nil, fmt.Errorf("%w: neither dense registers nor a sparse list", ErrInvalidEncoding)
+	}
+	// A damaged sketch may well be invalid too, but it's reported as corrupt.
+	if err := verifyChecksum(c, sum, p, pPrime, hashID, bigM, sparseList); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bigM != nil:
+		if expected := len(newNormal(decoded.m)); len(bigM) != expected {
+			return nil, fmt.Errorf("%w: %d bytes of registers, expected %d", ErrInvalidEncoding,
+				len(bigM), expected)
+		}
+		decoded.isSparse = false
+		decoded.sparseList = nil
+		decoded.bigM = bigM
+		decoded.hist = bigM.histogram(decoded.m)
+	case sparseList != nil:
+		if err := sparseList.validate(p, pPrime); err != nil {
+			return nil, err
+		}
+		decoded.sparseList = sparseList
+	}
+	decoded.hashID = hashID
+	decoded.checksum = c
+	return decoded, nil
+}
+
+// custom gob encoder and decoders. Gob uses the compressed binary encoding, but still decodes the
+// JSON that it used to use.
 func (h *Hll) GobEncode() ([]byte, error) {
-	return h.MarshalJSON()
+	return h.MarshalBinaryCompressed()
 }
 
 func (h *Hll) GobDecode(data []byte) error {
-	return h.UnmarshalJSON(data)
+	// A binary encoding starts with its version, never with the '{' of a JSON object.
+	if len(data) > 0 && data[0] == '{' {
+		return h.UnmarshalJSON(data)
+	}
+	return h.UnmarshalBinary(data)
 }
 
 // Returns linear counting cardinality estimate.
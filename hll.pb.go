@@ -29,6 +29,10 @@ type HllPb struct {
 	Pp               *int32       `protobuf:"varint,2,req,name=pp" json:"pp,omitempty"`
 	M                []byte       `protobuf:"bytes,3,opt" json:"M,omitempty"`
 	S                *HllPbSparse `protobuf:"bytes,4,opt,name=s" json:"s,omitempty"`
+	HashName         *string      `protobuf:"bytes,5,opt,name=hashName" json:"hashName,omitempty"`
+	HashSeed         *uint64      `protobuf:"varint,6,opt,name=hashSeed" json:"hashSeed,omitempty"`
+	ChecksumType     *uint32      `protobuf:"varint,7,opt,name=checksumType" json:"checksumType,omitempty"`
+	Checksum         *uint64      `protobuf:"varint,8,opt,name=checksum" json:"checksum,omitempty"`
 	XXX_unrecognized []byte       `json:"-"`
 }
 
@@ -64,6 +68,34 @@ func (m *HllPb) GetS() *HllPbSparse {
 	return nil
 }
 
+func (m *HllPb) GetHashName() string {
+	if m != nil && m.HashName != nil {
+		return *m.HashName
+	}
+	return ""
+}
+
+func (m *HllPb) GetHashSeed() uint64 {
+	if m != nil && m.HashSeed != nil {
+		return *m.HashSeed
+	}
+	return 0
+}
+
+func (m *HllPb) GetChecksumType() uint32 {
+	if m != nil && m.ChecksumType != nil {
+		return *m.ChecksumType
+	}
+	return 0
+}
+
+func (m *HllPb) GetChecksum() uint64 {
+	if m != nil && m.Checksum != nil {
+		return *m.Checksum
+	}
+	return 0
+}
+
 type HllPbSparse struct {
 	Buf              []byte  `protobuf:"bytes,1,opt,name=buf" json:"buf,omitempty"`
 	LastVal          *uint64 `protobuf:"varint,2,req,name=lastVal" json:"lastVal,omitempty"`
@@ -207,6 +239,83 @@ func (m *HllPb) Unmarshal(data []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field HashName", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := iNdEx + int(stringLen)
+			if int(stringLen) < 0 {
+				return ErrInvalidLengthHll
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			s := string(data[iNdEx:postIndex])
+			m.HashName = &s
+			iNdEx = postIndex
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field HashSeed", wireType)
+			}
+			var v uint64
+			for shift := uint(0); ; shift += 7 {
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				v |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.HashSeed = &v
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ChecksumType", wireType)
+			}
+			var v uint32
+			for shift := uint(0); ; shift += 7 {
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				v |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.ChecksumType = &v
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Checksum", wireType)
+			}
+			var v uint64
+			for shift := uint(0); ; shift += 7 {
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				v |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Checksum = &v
 		default:
 			var sizeOfWire int
 			for {
@@ -463,6 +572,19 @@ func (m *HllPb) Size() (n int) {
 		l = m.S.Size()
 		n += 1 + l + sovHll(uint64(l))
 	}
+	if m.HashName != nil {
+		l = len(*m.HashName)
+		n += 1 + l + sovHll(uint64(l))
+	}
+	if m.HashSeed != nil {
+		n += 1 + sovHll(uint64(*m.HashSeed))
+	}
+	if m.ChecksumType != nil {
+		n += 1 + sovHll(uint64(*m.ChecksumType))
+	}
+	if m.Checksum != nil {
+		n += 1 + sovHll(uint64(*m.Checksum))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -546,6 +668,27 @@ func (m *HllPb) MarshalTo(data []byte) (int, error) {
 		}
 		i += n1
 	}
+	if m.HashName != nil {
+		data[i] = 0x2a
+		i++
+		i = encodeVarintHll(data, i, uint64(len(*m.HashName)))
+		i += copy(data[i:], *m.HashName)
+	}
+	if m.HashSeed != nil {
+		data[i] = 0x30
+		i++
+		i = encodeVarintHll(data, i, uint64(*m.HashSeed))
+	}
+	if m.ChecksumType != nil {
+		data[i] = 0x38
+		i++
+		i = encodeVarintHll(data, i, uint64(*m.ChecksumType))
+	}
+	if m.Checksum != nil {
+		data[i] = 0x40
+		i++
+		i = encodeVarintHll(data, i, uint64(*m.Checksum))
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -1,7 +1,11 @@
 package hll
 
 import (
+	"errors"
+	"fmt"
 	"math"
+	"math/rand"
+	"sync"
 	"testing"
 
 	"github.com/bmizerany/assert"
@@ -51,6 +55,115 @@ func TestAddSparse(t *testing.T) {
 	}
 }
 
+// AddMany should give the same estimate as adding the hashes one at a time.
+func TestAddMany(t *testing.T) {
+	testCases := []struct {
+		before, batch  int
+		shouldBeSparse bool
+	}{
+		{0, 100, true},
+		{100, 200, true},     // Merged with an existing sparse list and temp set.
+		{0, 4000, false},     // The batch alone is over the sparse threshold.
+		{20000, 1000, false}, // Already dense.
+	}
+
+	for i, testCase := range testCases {
+		h, expected := NewHll(12, 25), NewHll(12, 25)
+		for _, x := range randUint64s(t, testCase.before) {
+			h.Add(x)
+			expected.Add(x)
+		}
+
+		batch := randUint64s(t, testCase.batch)
+		h.AddMany(batch)
+		assert.Equalf(t, h.isSparse, testCase.shouldBeSparse, "Testcase %d", i)
+		if h.isSparse {
+			assert.Equalf(t, len(h.tempSet), 0, "Testcase %d", i)
+		}
+
+		if !h.isSparse && expected.isSparse {
+			// The dense registers of the batch don't depend on when the switch happened.
+			expected.mergeTmpSetIfAny()
+			expected.switchToNormal()
+		}
+		for _, x := range batch {
+			expected.Add(x)
+		}
+		assert.Equalf(t, h.Cardinality(), expected.Cardinality(), "Testcase %d", i)
+	}
+}
+
+// The histogram of the dense registers should stay in sync with the registers through every
+// operation that changes them, so that the estimate is the same as from a full scan.
+func TestRegisterHistogram(t *testing.T) {
+	checkHist := func(name string, h *Hll) {
+		assert.Tf(t, !h.isSparse, "%s: sketch is sparse", name)
+		assert.Equalf(t, *h.hist, *h.bigM.histogram(h.m), "%s", name)
+
+		scanned := h.Copy()
+		scanned.hist = nil
+		assert.Equalf(t, h.Cardinality(), scanned.Cardinality(), "%s", name)
+	}
+
+	a, b := NewHll(12, 25), NewHll(12, 25)
+	for _, x := range randUint64s(t, 20000) {
+		a.Add(x)
+	}
+	checkHist("add", a)
+	b.AddMany(randUint64s(t, 30000))
+	checkHist("add many", b)
+
+	a.Combine(b)
+	checkHist("combine dense", a)
+	sparse := NewHll(12, 25)
+	sparse.AddMany(randUint64s(t, 100))
+	a.Combine(sparse)
+	checkHist("combine sparse", a)
+
+	reduced, err := a.Reduce(10, 25)
+	assert.Equal(t, nil, err)
+	checkHist("reduce", reduced)
+	union, err := UnionAll(a, b, sparse)
+	assert.Equal(t, nil, err)
+	checkHist("union", union)
+	checkHist("copy", a.Copy())
+
+	buf, err := a.MarshalJSON()
+	assert.Equal(t, nil, err)
+	fromJSON := &Hll{}
+	assert.Equal(t, fromJSON.UnmarshalJSON(buf), nil)
+	checkHist("json", fromJSON)
+	buf, err = a.MarshalPb()
+	assert.Equal(t, nil, err)
+	fromPb := &Hll{}
+	assert.Equal(t, fromPb.UnmarshalPb(buf), nil)
+	checkHist("pb", fromPb)
+}
+
+// Once the buffers are large enough, adding in the sparse case shouldn't allocate, including the
+// merges of the temp set.
+func TestAddSparseAllocs(t *testing.T) {
+	h := NewHll(14, 25)
+	xs := randUint64s(t, 200)
+	for _, x := range xs {
+		h.Add(x)
+	}
+	h.mergeTmpSetIfAny()
+
+	allocs := testing.AllocsPerRun(10, func() {
+		for _, x := range xs {
+			h.Add(x)
+		}
+		h.mergeTmpSetIfAny()
+	})
+	assert.Equal(t, allocs, 0.0)
+
+	// Adding the same inputs again doesn't change the sparse list.
+	once := NewHll(14, 25)
+	once.AddMany(xs)
+	assert.Equal(t, h.sparseList.buf, once.sparseList.buf)
+}
+
 // Test copying the HyperLogLog++
 func TestCopy(t *testing.T) {
 	h := NewHll(14, 25)
@@ -154,3 +267,157 @@ func TestCombine(t *testing.T) {
 		}
 	}
 }
+
+func TestCombineEMismatch(t *testing.T) {
+	h := NewHll(12, 25)
+	h.Add(randUint64(t))
+	other := NewHll(14, 20)
+	other.Add(randUint64(t))
+
+	err := h.CombineE(other)
+	assert.T(t, errors.Is(err, ErrPrecisionMismatch))
+
+	var mismatch *PrecisionMismatchError
+	assert.T(t, errors.As(err, &mismatch))
+	assert.Equal(t, *mismatch, PrecisionMismatchError{12, 25, 14, 20})
+
+	// Neither sketch should have been touched.
+	assert.Equal(t, len(other.tempSet), 1)
+	assert.Equal(t, len(h.tempSet), 1)
+
+	defer func() {
+		assert.T(t, recover() != nil)
+	}()
+	h.Combine(other)
+}
+
+// CombineReadOnly and Union must not modify their arguments, including their temp sets, and must
+// give the same result as Combine.
+func TestCombineReadOnly(t *testing.T) {
+	testCases := []struct {
+		count1, count2 int
+	}{
+		{50, 100},
+		{5000, 10},
+		{10, 5000},
+		{5000, 10000},
+	}
+
+	for i, testCase := range testCases {
+		hll1 := NewHll(12, 25)
+		for _, x := range randUint64s(t, testCase.count1) {
+			hll1.Add(x)
+		}
+		hll2 := NewHll(12, 25)
+		for _, x := range randUint64s(t, testCase.count2) {
+			hll2.Add(x)
+		}
+		before := hll2.Copy()
+
+		union, err := Union(hll1, hll2)
+		assert.Equal(t, nil, err)
+		readOnly := hll1.Copy()
+		err = readOnly.CombineReadOnly(hll2)
+		assert.Equal(t, nil, err)
+		assert.Equalf(t, hll2.tempSet, before.tempSet, "Testcase %d: argument was modified", i)
+		assert.Equalf(t, hll2.sparseList, before.sparseList, "Testcase %d: argument was modified", i)
+		assert.Equalf(t, hll2.isSparse, before.isSparse, "Testcase %d: argument was modified", i)
+
+		combined := hll1.Copy()
+		combined.Combine(hll2)
+		assert.Equalf(t, union.Cardinality(), combined.Cardinality(), "Testcase %d", i)
+		assert.Equalf(t, readOnly.Cardinality(), combined.Cardinality(), "Testcase %d", i)
+	}
+
+	_, err := Union(NewHll(12, 25), NewHll(12, 20))
+	assert.T(t, errors.Is(err, ErrPrecisionMismatch))
+}
+
+// A shared sketch can be combined into several others concurrently with CombineReadOnly.
+func TestCombineReadOnlyConcurrent(t *testing.T) {
+	shared := NewHll(12, 25)
+	for _, x := range randUint64s(t, 100) {
+		shared.Add(x)
+	}
+	want := shared.Copy().Cardinality()
+
+	var wg sync.WaitGroup
+	results := make([]uint64, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h := NewHll(12, 25)
+			h.CombineReadOnly(shared)
+			results[i] = h.Cardinality()
+		}(i)
+	}
+	wg.Wait()
+
+	for _, card := range results {
+		assert.Equal(t, card, want)
+	}
+}
+
+// Returns n pseudo-random hashes. They're deterministic so that benchmark runs are comparable.
+func benchHashes(n int) []uint64 {
+	rnd := rand.New(rand.NewSource(1))
+	xs := make([]uint64, n)
+	for i := range xs {
+		xs[i] = rnd.Uint64()
+	}
+	return xs
+}
+
+func BenchmarkAddSparse(b *testing.B) {
+	// Few enough inputs that the sketch stays sparse.
+	xs := benchHashes(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h := NewHll(14, 25)
+		for _, x := range xs {
+			h.Add(x)
+		}
+	}
+	b.SetBytes(int64(len(xs)) * 8)
+}
+
+func BenchmarkAddDense(b *testing.B) {
+	xs := benchHashes(1 << 16)
+	for _, layout := range testLayouts {
+		h, _ := New(layout.opts...)
+		h.switchToNormal()
+		b.Run(layout.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				h.Add(xs[i%len(xs)])
+			}
+		})
+	}
+}
+
+func BenchmarkCombineDense(b *testing.B) {
+	for _, layout := range testLayouts {
+		x, _ := New(layout.opts...)
+		y, _ := New(layout.opts...)
+		x.AddMany(benchHashes(1 << 16))
+		y.AddMany(benchHashes(1 << 17))
+		b.Run(layout.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				x.Combine(y)
+			}
+		})
+	}
+}
+
+func BenchmarkCardinality(b *testing.B) {
+	for _, p := range []uint{14, 18} {
+		h := NewHll(p, 25)
+		h.AddMany(benchHashes(1 << 20))
+		b.Run(fmt.Sprintf("p=%d", p), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				h.Cardinality()
+			}
+		})
+	}
+}
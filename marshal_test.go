@@ -5,6 +5,7 @@ import (
 	crand "crypto/rand"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	mrand "math/rand"
 	"testing"
 
@@ -192,3 +193,217 @@ func TestCompression(t *testing.T) {
 		assert.Equal(t, buf, roundTripped)
 	}
 }
+
+func TestMarshalBinaryRoundTrip(t *testing.T) {
+	testCases := []struct {
+		p, pPrime uint
+	}{
+		{5, 10},
+		{10, 25},
+		{15, 25},
+	}
+
+	for _, testCase := range testCases {
+		h := NewHll(testCase.p, testCase.pPrime)
+		for i := uint64(0); i <= 1e5; i++ {
+			if i%5000 == 0 {
+				for _, marshal := range []func() ([]byte, error){h.MarshalBinary,
+					h.MarshalBinaryCompressed} {
+					buf, err := marshal()
+					assert.Equalf(t, nil, err, "%v", err)
+
+					rt := &Hll{}
+					err = rt.UnmarshalBinary(buf)
+					assert.Equalf(t, nil, err, "%v", err)
+
+					assert.Equal(t, rt.isSparse, h.isSparse)
+					if h.isSparse {
+						assert.Equal(t, *rt.sparseList, *h.sparseList)
+					} else {
+						assert.Equal(t, rt.bigM, h.bigM)
+					}
+					assert.Equal(t, rt.Cardinality(), h.Cardinality())
+				}
+			}
+
+			h.Add(randUint64(t))
+		}
+
+		assert.T(t, !h.isSparse) // Ensure we stored enough to use the dense representation.
+	}
+}
+
+// The binary layout is stable, so check it byte by byte.
+func TestMarshalBinaryLayout(t *testing.T) {
+	h := NewHll(4, 10)
+	h.hashID = HashID{"ab", 300}
+	h.Add(0)
+	buf, err := h.MarshalBinary()
+	assert.Equal(t, nil, err)
+	// The only encoded hash is both lastVal and the first delta of the sparse list.
+	k := encodeHash(0, 4, 10)
+	assert.T(t, k < 0x80) // So its varint is a single byte.
+	expected := []byte{
+		binaryVersion, binaryFlagHashID, 4, 10,
+		2, 'a', 'b', 0xac, 0x02, // The hash ID, with the seed 300 as a varint.
+		1,       // numElements
+		byte(k), // lastVal
+		byte(k), // The payload
+	}
+	assert.Equal(t, buf, expected)
+
+	h.switchToNormal()
+	h.hashID = HashID{}
+	buf, err = h.MarshalBinary()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, buf[:4], []byte{binaryVersion, binaryFlagDense, 4, 10})
+	assert.Equal(t, normal(buf[4:]), h.bigM)
+}
+
+func TestUnmarshalBinaryErrors(t *testing.T) {
+	h := NewHll(10, 25)
+	h.AddString("a")
+	valid, err := h.MarshalBinary()
+	assert.Equal(t, nil, err)
+	h.switchToNormal()
+	dense, err := h.MarshalBinaryCompressed()
+	assert.Equal(t, nil, err)
+
+	testCases := [][]byte{
+		nil,
+		valid[:3],
+		append([]byte{binaryVersion + 1}, valid[1:]...),
+		append([]byte{binaryVersion, 0x80}, valid[2:]...),     // Unknown flag
+		append([]byte{binaryVersion, 0, 3, 25}, valid[4:]...), // Invalid p
+		valid[:5],                                // Truncated hash name
+		append(dense[:len(dense):len(dense)], 0), // Corrupt snappy data
+		append([]byte{binaryVersion, binaryFlagDense, 10, 25}, 1, 2, 3), // Short registers
+	}
+	for i, buf := range testCases {
+		rt := &Hll{}
+		err := rt.UnmarshalBinary(buf)
+		assert.Tf(t, errors.Is(err, ErrInvalidEncoding), "Testcase %d: %v", i, err)
+	}
+}
+
+// Gob used to encode JSON, which must still decode.
+func TestGobDecodeJSON(t *testing.T) {
+	h := NewHll(10, 25)
+	for i := 0; i < 10000; i++ {
+		h.Add(randUint64(t))
+	}
+	jBuf, err := json.Marshal(h)
+	assert.Equal(t, nil, err)
+
+	rt := &Hll{}
+	assert.Equal(t, rt.GobDecode(jBuf), nil)
+	assert.Equal(t, rt.Cardinality(), h.Cardinality())
+
+	gobBuf, err := h.GobEncode()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, gobBuf[0], byte(binaryVersion))
+	assert.T(t, len(gobBuf) < len(jBuf))
+}
+
+// Returns the JSON of a sparse sketch with p=10, pPrime=25 and the given sparse list.
+func sparseJSON(t *testing.T, s *sparse) []byte {
+	buf, err := json.Marshal(&jsonableHll{SparseList: s, P: 10, PPrime: 25})
+	assert.Equal(t, nil, err)
+	return buf
+}
+
+func TestUnmarshalJSONErrors(t *testing.T) {
+	// Two encoded hashes, in order of their indexes.
+	k1, k2 := encodeHash(1<<40, 10, 25), encodeHash(1<<41, 10, 25)
+	valid := func() *sparse {
+		s := newSparse(0)
+		s.Add(k1)
+		s.Add(k2)
+		return s
+	}
+	assert.Equal(t, (&Hll{}).UnmarshalJSON(sparseJSON(t, valid())), nil)
+
+	wrongCount, wrongLast, tooMany := valid(), valid(), valid()
+	wrongCount.numElements--
+	wrongLast.lastVal = k1
+	tooMany.numElements = 1<<10 + 1
+	unsorted := newSparse(0)
+	unsorted.Add(k2)
+	unsorted.Add(k1)
+	notEncoded := newSparse(0)
+	notEncoded.Add(1) // A flagged hash with a rho of zero
+	truncated := &sparse{[]byte{0x80}, 0, 1}
+
+	testCases := [][]byte{
+		nil,
+		[]byte("{"),
+		[]byte(`{"p":3,"pp":25,"s":{"B":"AA==","L":0,"N":0}}`), // Invalid p
+		[]byte(`{"p":10,"pp":25}`),                             // No registers or sparse list
+		[]byte(`{"p":10,"pp":25,"M":"AAAA"}`),                  // Short registers
+		[]byte(`{"p":10,"pp":25,"s":{"B":"!!!!","L":0,"N":0}}`),
+		sparseJSON(t, wrongCount),
+		sparseJSON(t, wrongLast),
+		sparseJSON(t, tooMany),
+		sparseJSON(t, unsorted),
+		sparseJSON(t, notEncoded),
+		sparseJSON(t, truncated),
+	}
+	for i, buf := range testCases {
+		rt := &Hll{}
+		err := rt.UnmarshalJSON(buf)
+		assert.Tf(t, errors.Is(err, ErrInvalidEncoding), "Testcase %d: %v", i, err)
+	}
+}
+
+func TestUnmarshalPbErrors(t *testing.T) {
+	h := NewHll(10, 25)
+	h.switchToNormal()
+	dense, err := h.MarshalPb()
+	assert.Equal(t, nil, err)
+
+	testCases := [][]byte{
+		{0xff},
+		{0x08, 10},                               // No pp
+		{0x08, 10, 0x10, 25, 0x22, 0x00},         // A sparse list without lastVal and numElements
+		{0x08, 3, 0x10, 25, 0x1a, 1, 0},          // Invalid p
+		{0x08, 10, 0x10, 25},                     // No registers or sparse list
+		{0x08, 10, 0x10, 25, 0x1a, 1, 0},         // Short registers
+		append(dense, 0x22, 4, 0x10, 0, 0x18, 0), // Registers and a sparse list
+	}
+	for i, buf := range testCases {
+		rt := &Hll{}
+		err := rt.UnmarshalPb(buf)
+		assert.Tf(t, errors.Is(err, ErrInvalidEncoding), "Testcase %d: %v", i, err)
+	}
+}
+
+func TestUnmarshalBinarySparseErrors(t *testing.T) {
+	header := []byte{binaryVersion, 0, 10, 25}
+	k := encodeHash(1<<54|1<<40, 10, 25)
+	valid := appendUvarint(appendUvarint(appendUvarint(header, 1), k), k)
+	rt := &Hll{}
+	assert.Equal(t, rt.UnmarshalBinary(valid), nil)
+	// The low-order bits of the hash are all zero, so its rho is 63.
+	zeros := encodeHash(1<<54, 10, 25)
+	assert.Equal(t, rt.UnmarshalBinary(appendUvarint(appendUvarint(appendUvarint(header, 1),
+		zeros), zeros)), nil)
+	// The rho of 39 low-order bits can't be 62.
+	badRho := uint64(1)<<15<<7 | 62<<1 | 1
+
+	// Snappy data that claims to decode to 4GB.
+	bomb := append([]byte{binaryVersion, binaryFlagCompressed | binaryFlagDense, 10, 25},
+		0xff, 0xff, 0xff, 0xff, 0x0f)
+
+	testCases := [][]byte{
+		appendUvarint(appendUvarint(appendUvarint(header, 2), k), k), // Wrong count
+		appendUvarint(appendUvarint(appendUvarint(header, 1), k), 0), // Wrong last value
+		appendUvarint(appendUvarint(appendUvarint(header, 1), 1), 1), // Not an encoded hash
+		appendUvarint(appendUvarint(appendUvarint(header, 1), badRho), badRho),
+		bomb,
+	}
+	for i, buf := range testCases {
+		rt := &Hll{}
+		err := rt.UnmarshalBinary(buf)
+		assert.Tf(t, errors.Is(err, ErrInvalidEncoding), "Testcase %d: %v", i, err)
+	}
+}
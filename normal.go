@@ -1,7 +1,9 @@
 package hll
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math/bits"
 )
 
 type normal []byte
@@ -12,41 +14,60 @@ func newNormal(numRegisters uint64) normal {
 	return make([]byte, numBytes)
 }
 
+// Registers are packed four to a group of three bytes. Register 0 of a group is in the low 6 bits
+// of its first byte. Register 1 has its high 2 bits in the top of the first byte and its low 4 bits
+// in the bottom of the second. Register 2 has its high 4 bits in the top of the second byte and its
+// low 2 bits in the bottom of the third. Register 3 is in the top 6 bits of the third byte.
+
 // This function assumes that registerIdx is within range. It may panic if not.
 func (n normal) Get(registerIdx uint64) uint8 {
-	byteIdx, startBit, numInSecondByte := bitPosn(registerIdx)
-
-	result := (n[byteIdx] >> startBit) & 0x3f
-	if numInSecondByte == 0 {
-		return result
+	b := n[registerIdx/4*3:]
+	switch registerIdx % 4 {
+	case 0:
+		return b[0] & 0x3f
+	case 1:
+		return b[0]>>6<<4 | b[1]&0x0f
+	case 2:
+		return b[1]>>4<<2 | b[2]&0x03
+	default:
+		return b[2] >> 2
 	}
-	result <<= numInSecondByte
-	lowOrderMask := uint8(onesFromTo(0, numInSecondByte-1))
-	result |= n[byteIdx+1] & lowOrderMask
-	return result
 }
 
 func (n normal) Set(registerIdx uint64, val uint8) {
-	byteIdx, startBit, numInSecondByte := bitPosn(registerIdx)
-
-	// if val&0x3f != val {
-	// 	panic("register values should only have their lower 6 bits set.") // TODO remove for prod
-	// }
-
-	b1 := n[byteIdx]
-	b1 = b1 &^ uint8(onesFromTo(startBit, startBit+6-1)) // Clear bits holding this register.
-	b1 |= (val >> numInSecondByte) << startBit
-	n[byteIdx] = b1
+	b := n[registerIdx/4*3:]
+	switch registerIdx % 4 {
+	case 0:
+		b[0] = b[0]&0xc0 | val
+	case 1:
+		b[0] = b[0]&0x3f | val>>4<<6
+		b[1] = b[1]&0xf0 | val&0x0f
+	case 2:
+		b[1] = b[1]&0x0f | val>>2<<4
+		b[2] = b[2]&0xfc | val&0x03
+	default:
+		b[2] = b[2]&0x03 | val<<2
+	}
+}
 
-	if numInSecondByte == 0 {
-		return
+// Returns the four registers of the group that starts at register 4*group. The group must be
+// complete, which it always is when the number of registers is a multiple of 4.
+func (n normal) getGroup(group uint64) [4]uint8 {
+	b := n[group*3 : group*3+3]
+	return [4]uint8{
+		b[0] & 0x3f,
+		b[0]>>6<<4 | b[1]&0x0f,
+		b[1]>>4<<2 | b[2]&0x03,
+		b[2] >> 2,
 	}
+}
 
-	b2 := n[byteIdx+1]
-	lowOrderMask := uint8(onesFromTo(0, numInSecondByte-1))
-	b2 = b2 &^ lowOrderMask // Clear bits holding this register.
-	b2 |= (val & lowOrderMask)
-	n[byteIdx+1] = b2
+// Sets the four registers of the group that starts at register 4*group.
+func (n normal) setGroup(group uint64, regs [4]uint8) {
+	b := n[group*3 : group*3+3]
+	b[0] = regs[0] | regs[1]>>4<<6
+	b[1] = regs[1]&0x0f | regs[2]>>2<<4
+	b[2] = regs[2]&0x03 | regs[3]<<2
 }
 
 func (n normal) Size() int {
@@ -59,6 +80,128 @@ func (n normal) Copy() normal {
 	return cp
 }
 
+func (n normal) clone() registers {
+	return n.Copy()
+}
+
+func (n normal) packed(numRegisters uint64) normal {
+	return n
+}
+
+func (n normal) maxMerge(other registers, numRegisters uint64, hist *registerHist) {
+	o, ok := other.(normal)
+	if !ok {
+		maxMergeRegisters(n, other, numRegisters, hist)
+		return
+	}
+	// The number of registers is a power of two and at least 16, so the registers are in complete
+	// words of 8.
+	for w := uint64(0); w < numRegisters/8; w++ {
+		lanes := n.loadLanes(w)
+		merged := maxLanes(lanes, o.loadLanes(w))
+		if merged == lanes {
+			continue
+		}
+		if hist != nil {
+			for changed := merged ^ lanes; changed != 0; {
+				shift := uint(bits.TrailingZeros64(changed)) / 6 * 6
+				hist[lanes>>shift&0x3f]--
+				hist[merged>>shift&0x3f]++
+				changed &^= 0x3f << shift
+			}
+		}
+		n.storeLanes(w, merged)
+	}
+}
+
+// The registers can also be accessed a word of eight at a time: the six bytes of two groups are
+// read with a single 64-bit load where the buffer allows it. Since registers 1 and 2 of a group are
+// split across bytes, the word is rearranged into lanes, with register i of the eight in bits 6i to
+// 6i+5. The masks select bits of both groups in the word.
+const (
+	wordBytes = 6
+	wordMask  = 1<<(8*wordBytes) - 1
+
+	unchangedBits = 0xfc003f | 0xfc003f<<24 // Registers 0 and 3 are in place.
+)
+
+// Returns the registers of word w, which are registers 8w to 8w+7, as lanes.
+func (n normal) loadLanes(w uint64) uint64 {
+	var x uint64
+	if b := n[w*wordBytes:]; len(b) >= 8 {
+		x = binary.LittleEndian.Uint64(b) & wordMask
+	} else {
+		x = uint64(binary.LittleEndian.Uint32(b)) | uint64(binary.LittleEndian.Uint16(b[4:]))<<32
+	}
+	return x&unchangedBits |
+		x<<4&(0xc00|0xc00<<24) | x>>2&(0x3c0|0x3c0<<24) | // Register 1
+		x<<2&(0x3c000|0x3c000<<24) | x>>4&(0x3000|0x3000<<24) // Register 2
+}
+
+// Sets the registers of word w to lanes.
+func (n normal) storeLanes(w uint64, lanes uint64) {
+	x := lanes&unchangedBits |
+		lanes>>4&(0xc0|0xc0<<24) | lanes<<2&(0xf00|0xf00<<24) | // Register 1
+		lanes>>2&(0xf000|0xf000<<24) | lanes<<4&(0x30000|0x30000<<24) // Register 2
+	if b := n[w*wordBytes:]; len(b) >= 8 {
+		binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)&^wordMask|x)
+	} else {
+		binary.LittleEndian.PutUint32(b, uint32(x))
+		binary.LittleEndian.PutUint16(b[4:], uint16(x>>32))
+	}
+}
+
+// The even lanes of a word, spread out to 12 bits each so that they can be compared without the
+// borrows of a subtraction crossing from one lane to the next.
+const (
+	evenLanes  = 0x03f03f03f03f
+	laneGuards = 0x040040040040 // The bit above each spread out lane.
+)
+
+// Returns the lanes that are the maximum of the lanes of a and b, using SWAR (SIMD within a
+// register) arithmetic.
+func maxLanes(a, b uint64) uint64 {
+	return maxSpreadLanes(a&evenLanes, b&evenLanes) |
+		maxSpreadLanes(a>>6&evenLanes, b>>6&evenLanes)<<6
+}
+
+// Returns the maximum of each of the spread out lanes of a and b.
+func maxSpreadLanes(a, b uint64) uint64 {
+	// 64+a-b is in [1,127] for each lane, and keeps the guard bit exactly when a >= b.
+	aIsMax := (((a | laneGuards) - b) & laneGuards >> 6) * 0x3f
+	return a&aIsMax | b&^aIsMax
+}
+
+// The number of registers that hold each value. Registers have 6 bits, so there are 64 values.
+type registerHist [64]uint64
+
+// Returns the histogram of the values of the first numRegisters registers.
+func (n normal) histogram(numRegisters uint64) *registerHist {
+	hist := &registerHist{}
+	numGroups := numRegisters / 4
+	for g := uint64(0); g < numGroups; g++ {
+		regs := n.getGroup(g)
+		hist[regs[0]]++
+		hist[regs[1]]++
+		hist[regs[2]]++
+		hist[regs[3]]++
+	}
+	for i := numGroups * 4; i < numRegisters; i++ {
+		hist[n.Get(i)]++
+	}
+	return hist
+}
+
+// Returns the sum of 2^-M[i] over all registers and the number of registers that are zero. The sum
+// is taken in order of register value, so it only depends on the histogram and not on the order of
+// the registers.
+func (r *registerHist) sums() (inverseSum float64, V uint64) {
+	for val, count := range r {
+		inverseSum += float64(count) / lookupTable[val]
+	}
+	return inverseSum, r[0]
+}
+
 func (n *normal) MarshalJSON() ([]byte, error) {
 	compressed, err := snappyB64(*n)
 	if err != nil {
@@ -89,18 +232,6 @@ func (n *normal) UnmarshalJSON(buf []byte) error {
 	return nil
 }
 
-// Given a register number, returns the bit position where it can be found in the byte slice.
-func bitPosn(registerIdx uint64) (byteIdx uint64, startBit, numInSecondByte uint) {
-	bitIdx := registerIdx * 6
-
-	byteIdx = bitIdx / 8
-	startBit = uint(bitIdx % 8)
-	numInFirstByte := minUint(6, 8-startBit)
-	numInSecondByte = 6 - numInFirstByte
-
-	return
-}
-
 func minUint(x, y uint) uint {
 	if x <= y {
 		return x
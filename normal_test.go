@@ -1,8 +1,12 @@
 package hll
 
 import (
+	"bytes"
+	mrand "math/rand"
 	"os"
 	"testing"
+
+	"github.com/bmizerany/assert"
 )
 
 func TestNormal(t *testing.T) {
@@ -43,3 +47,113 @@ func iterativeGetSet(t *testing.T, numRegisters uint64) {
 		}
 	}
 }
+
+// The register layout must not change, so that serialized sketches still decode identically.
+// Compare against the original implementation, which set and got registers a bit range at a time.
+func TestNormalLayout(t *testing.T) {
+	for _, numRegisters := range []uint64{16, 1023, 1024, 1025, 1026, 1 << 14} {
+		n, old := newNormal(numRegisters), newNormal(numRegisters)
+		for j := 0; j < 10000; j++ {
+			i := uint64(mrand.Int63n(int64(numRegisters)))
+			val := uint8(mrand.Intn(64))
+			n.Set(i, val)
+			oldSet(old, i, val)
+			assert.Equalf(t, n.Get(i), val, "register %d of %d", i, numRegisters)
+		}
+		assert.Tf(t, bytes.Equal(n, old), "%d registers: layout changed", numRegisters)
+		for i := uint64(0); i < numRegisters; i++ {
+			assert.Equal(t, n.Get(i), oldGet(old, i))
+		}
+
+		// Groups hold the same registers as Get and Set.
+		for g := uint64(0); g < numRegisters/4; g++ {
+			regs := n.getGroup(g)
+			for j := uint64(0); j < 4; j++ {
+				assert.Equal(t, regs[j], n.Get(4*g+j))
+			}
+			regs[0], regs[3] = regs[3], regs[0]
+			n.setGroup(g, regs)
+			oldSet(old, 4*g, regs[0])
+			oldSet(old, 4*g+3, regs[3])
+		}
+		assert.Tf(t, bytes.Equal(n, old), "%d registers: group layout changed", numRegisters)
+
+		// Words hold the same registers as Get and Set, in lanes of 6 bits.
+		for w := uint64(0); w < numRegisters/8; w++ {
+			lanes := n.loadLanes(w)
+			for j := uint64(0); j < 8; j++ {
+				assert.Equal(t, uint8(lanes>>(6*j)&0x3f), n.Get(8*w+j))
+			}
+			lanes = lanes>>6 | lanes&0x3f<<42 // Rotate the registers of the word.
+			n.storeLanes(w, lanes)
+			for j := uint64(0); j < 8; j++ {
+				oldSet(old, 8*w+j, uint8(lanes>>(6*j)&0x3f))
+			}
+		}
+		assert.Tf(t, bytes.Equal(n, old), "%d registers: word layout changed", numRegisters)
+	}
+}
+
+func TestNormalMaxMerge(t *testing.T) {
+	const numRegisters = 1 << 10
+	for i := 0; i < 10; i++ {
+		n, other := newNormal(numRegisters), newNormal(numRegisters)
+		for j := uint64(0); j < numRegisters; j++ {
+			// Mostly small values, so that many registers are equal.
+			n.Set(j, uint8(mrand.Intn(64)>>uint(mrand.Intn(6))))
+			other.Set(j, uint8(mrand.Intn(64)>>uint(mrand.Intn(6))))
+		}
+		expected := n.Copy()
+		for j := uint64(0); j < numRegisters; j++ {
+			expected.Set(j, maxU8(n.Get(j), other.Get(j)))
+		}
+
+		hist := n.histogram(numRegisters)
+		n.maxMerge(other, numRegisters, hist)
+		assert.Equal(t, n, expected)
+		assert.Equal(t, *hist, *expected.histogram(numRegisters))
+	}
+}
+
+func oldGet(n normal, registerIdx uint64) uint8 {
+	byteIdx, startBit, numInSecondByte := oldBitPosn(registerIdx)
+
+	result := (n[byteIdx] >> startBit) & 0x3f
+	if numInSecondByte == 0 {
+		return result
+	}
+	result <<= numInSecondByte
+	lowOrderMask := uint8(onesFromTo(0, numInSecondByte-1))
+	result |= n[byteIdx+1] & lowOrderMask
+	return result
+}
+
+func oldSet(n normal, registerIdx uint64, val uint8) {
+	byteIdx, startBit, numInSecondByte := oldBitPosn(registerIdx)
+
+	b1 := n[byteIdx]
+	b1 = b1 &^ uint8(onesFromTo(startBit, startBit+6-1))
+	b1 |= (val >> numInSecondByte) << startBit
+	n[byteIdx] = b1
+
+	if numInSecondByte == 0 {
+		return
+	}
+
+	b2 := n[byteIdx+1]
+	lowOrderMask := uint8(onesFromTo(0, numInSecondByte-1))
+	b2 = b2 &^ lowOrderMask
+	b2 |= (val & lowOrderMask)
+	n[byteIdx+1] = b2
+}
+
+func oldBitPosn(registerIdx uint64) (byteIdx uint64, startBit, numInSecondByte uint) {
+	bitIdx := registerIdx * 6
+
+	byteIdx = bitIdx / 8
+	startBit = uint(bitIdx % 8)
+	numInFirstByte := minUint(6, 8-startBit)
+	numInSecondByte = 6 - numInFirstByte
+
+	return
+}
@@ -0,0 +1,186 @@
+package hll
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// The precision limits come from the bias tables in the appendix of the paper, which cover
+	// p in [4,18].
+	minP = 4
+	maxP = 18
+
+	// A sparse encoded hash holds pPrime index bits, a 6-bit rho value and a 1-bit flag, and it
+	// has to fit in a uint64.
+	maxPPrime = 64 - 6 - 1
+
+	defaultP      = 14
+	defaultPPrime = 25
+)
+
+var (
+	// ErrInvalidP is returned when the dense precision p is outside of [4,18].
+	ErrInvalidP = errors.New("hll: p must be in the range [4,18]")
+
+	// ErrInvalidPPrime is returned when the sparse precision pPrime isn't greater than p, or is too
+	// large to leave room for the rho value and flag bit in an encoded hash.
+	ErrInvalidPPrime = errors.New("hll: pPrime must be greater than p and at most 57")
+
+	// ErrInvalidThreshold is returned when the sparse threshold or the merge size is unusable.
+	ErrInvalidThreshold = errors.New("hll: invalid sparse threshold")
+
+	// ErrInvalidChecksum is returned when WithChecksum is given an unknown checksum.
+	ErrInvalidChecksum = errors.New("hll: unknown checksum")
+)
+
+// Option configures an Hll created by New.
+type Option func(*options)
+
+type options struct {
+	p, pPrime           uint
+	sparseThresholdBits uint64 // zero means "use the default for p"
+	mergeSizeBits       uint64 // zero means "use the default for the sparse threshold"
+	hasher              Hasher // nil means "use XXHash64"
+	hashID              HashID // zero means "use the ID of the hasher, if it has one"
+	layout              registerLayout
+	checksum            Checksum
+}
+
+// WithP sets the precision used by the dense representation. The dense representation uses 2^p
+// registers. The default is 14.
+func WithP(p uint) Option {
+	return func(o *options) {
+		o.p = p
+	}
+}
+
+// WithPPrime sets the precision used by the sparse representation. It must be greater than p. The
+// default is 25.
+func WithPPrime(pPrime uint) Option {
+	return func(o *options) {
+		o.pPrime = pPrime
+	}
+}
+
+// WithSparseThresholdBits sets the size in bits that the sparse list may reach before the sketch is
+// converted to the dense representation. The default is 6*2^p, which is the size of the dense
+// representation.
+func WithSparseThresholdBits(bits uint64) Option {
+	return func(o *options) {
+		o.sparseThresholdBits = bits
+	}
+}
+
+// WithMergeSizeBits sets the size in bits that the temporary set may reach before it's merged into
+// the sparse list. The default is a quarter of the sparse threshold.
+func WithMergeSizeBits(bits uint64) Option {
+	return func(o *options) {
+		o.mergeSizeBits = bits
+	}
+}
+
+// WithHasher sets the Hasher used by AddBytes, AddString and AddUint64Value. The default is
+// XXHash64 with a seed of 0. Sketches that will be combined must use the same hasher. If hasher is
+// an IdentifiedHasher, the sketch records its HashID.
+//
+// The hasher itself isn't serialized, only its HashID. An unmarshaled sketch finds its hasher with
+// the registry (see RegisterHasher); otherwise it has to be set again with SetHasher.
+func WithHasher(hasher Hasher) Option {
+	return func(o *options) {
+		o.hasher = hasher
+	}
+}
+
+// WithHashID sets the HashID that the sketch records, for sketches whose hasher doesn't identify
+// itself, or whose hashes are computed outside of the sketch and passed to Add.
+func WithHashID(id HashID) Option {
+	return func(o *options) {
+		o.hashID = id
+	}
+}
+
+// WithUnpackedRegisters makes the dense representation use a whole byte for each register, instead
+// of packing the 6-bit registers four to three bytes. That takes 2^p bytes instead of 0.75*2^p, but
+// adding to and combining dense sketches is faster. It's meant for sketches that are kept in memory
+// and updated often.
+//
+// The registers are always serialized in the packed layout, so an unmarshaled sketch uses the
+// packed layout. Sketches with different layouts can be combined.
+func WithUnpackedRegisters() Option {
+	return withLayout(unpackedLayout)
+}
+
+// WithCompactRegisters makes the dense representation use 4 bits for each register instead of 6,
+// as an offset from the value of the smallest register. The few registers that are too far above
+// the smallest one are kept in a separate map, so no register value is lost. That takes about a
+// third less memory than the default layout, but combining dense sketches is slower, since the
+// registers have to be merged one at a time. It's meant for applications that keep many sketches
+// in memory.
+//
+// The registers are always serialized in the packed layout, so an unmarshaled sketch uses the
+// packed layout. Sketches with different layouts can be combined.
+func WithCompactRegisters() Option {
+	return withLayout(compactLayout)
+}
+
+// WithChecksum makes the sketch embed a checksum of type c when it's marshaled with MarshalBinary,
+// MarshalBinaryCompressed, MarshalJSON, MarshalPb or GobEncode. Unmarshaling checks it, and a
+// sketch that was unmarshaled embeds the same type of checksum when it's marshaled again. The
+// default is ChecksumNone.
+func WithChecksum(c Checksum) Option {
+	return func(o *options) {
+		o.checksum = c
+	}
+}
+
+// Sets the layout of the dense registers, for sketches that are derived from an existing sketch.
+func withLayout(layout registerLayout) Option {
+	return func(o *options) {
+		o.layout = layout
+	}
+}
+
+func defaultOptions() options {
+	return options{
+		p:      defaultP,
+		pPrime: defaultPPrime,
+	}
+}
+
+// Checks the options and fills in the defaults that depend on other options.
+func (o *options) validate() error {
+	if o.p < minP || o.p > maxP {
+		return fmt.Errorf("%w: got p=%d", ErrInvalidP, o.p)
+	}
+	if o.pPrime <= o.p || o.pPrime > maxPPrime {
+		return fmt.Errorf("%w: got p=%d, pPrime=%d", ErrInvalidPPrime, o.p, o.pPrime)
+	}
+
+	if o.sparseThresholdBits == 0 {
+		// The sparse threshold (the threshold for when to convert to the normal case) is set to
+		// m.6 bits.
+		o.sparseThresholdBits = (uint64(1) << o.p) * 6
+	}
+	if o.mergeSizeBits == 0 {
+		// When the temp set reaches 25% of the maximum size for sparse register storage, merge the
+		// temp set with the sparse list.
+		o.mergeSizeBits = o.sparseThresholdBits / 4
+	}
+	if o.mergeSizeBits > o.sparseThresholdBits {
+		return fmt.Errorf("%w: merge size %d bits is larger than the sparse threshold %d bits",
+			ErrInvalidThreshold, o.mergeSizeBits, o.sparseThresholdBits)
+	}
+
+	if o.checksum >= numChecksums {
+		return fmt.Errorf("%w: %v", ErrInvalidChecksum, o.checksum)
+	}
+
+	if err := checkHashIDs(o.hashID, hasherID(o.hasher)); err != nil {
+		return err
+	}
+	if o.hashID.IsZero() {
+		o.hashID = hasherID(o.hasher)
+	}
+	return nil
+}
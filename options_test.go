@@ -0,0 +1,64 @@
+package hll
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestNewDefaults(t *testing.T) {
+	h, err := New()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, h.p, uint(14))
+	assert.Equal(t, h.pPrime, uint(25))
+	assert.Equal(t, h.sparseThresholdBits, uint64(6<<14))
+	assert.Equal(t, h.mergeSizeBits, uint64(6<<14)/4)
+	assert.T(t, h.isSparse)
+}
+
+func TestNewOptions(t *testing.T) {
+	h, err := New(WithP(10), WithPPrime(20), WithSparseThresholdBits(4096), WithMergeSizeBits(512))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, h.p, uint(10))
+	assert.Equal(t, h.pPrime, uint(20))
+	assert.Equal(t, h.m, uint64(1024))
+	assert.Equal(t, h.mPrime, uint64(1<<20))
+	assert.Equal(t, h.sparseThresholdBits, uint64(4096))
+	assert.Equal(t, h.mergeSizeBits, uint64(512))
+}
+
+func TestNewInvalid(t *testing.T) {
+	testCases := []struct {
+		opts   []Option
+		expect error
+	}{
+		{[]Option{WithP(3)}, ErrInvalidP},
+		{[]Option{WithP(19)}, ErrInvalidP},
+		{[]Option{WithP(14), WithPPrime(14)}, ErrInvalidPPrime},
+		{[]Option{WithP(14), WithPPrime(10)}, ErrInvalidPPrime},
+		{[]Option{WithP(14), WithPPrime(58)}, ErrInvalidPPrime},
+		{[]Option{WithSparseThresholdBits(100), WithMergeSizeBits(200)}, ErrInvalidThreshold},
+	}
+
+	for i, testCase := range testCases {
+		h, err := New(testCase.opts...)
+		if !errors.Is(err, testCase.expect) {
+			t.Errorf("Case %d: expected %v but got %v", i, testCase.expect, err)
+		}
+		if h != nil {
+			t.Errorf("Case %d: expected a nil Hll on error", i)
+		}
+	}
+
+	// pPrime at the upper limit still leaves room for rho and the flag bit.
+	_, err := New(WithP(18), WithPPrime(57))
+	assert.Equal(t, nil, err)
+}
+
+func TestNewHllPanics(t *testing.T) {
+	defer func() {
+		assert.T(t, recover() != nil)
+	}()
+	NewHll(14, 10)
+}
@@ -0,0 +1,395 @@
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Sketches of the postgresql-hll extension (https://github.com/citusdata/postgresql-hll) are stored
+// in the Aggregate Knowledge storage specification, version 1. It's also used by java-hll and
+// js-hll. A stored sketch starts with three bytes:
+//
+//	version and type  the version (1) in the top 4 bits, and the type in the bottom 4 bits
+//	parameters        regwidth-1 in the top 3 bits, and log2m in the bottom 5 bits
+//	cutoff            0, then the sparseon bit, then 6 bits of the explicit threshold
+//
+// and continues with the data of its type. An EMPTY sketch has no data. An EXPLICIT sketch is the
+// distinct raw hashes, as big-endian int64s in ascending order. A SPARSE sketch is the registers
+// that aren't zero, each as a log2m-bit index followed by a regwidth-bit value. A FULL sketch is all
+// 2^log2m registers, regwidth bits each. SPARSE and FULL sketches are bit strings, packed from the
+// most significant bit of each byte, and padded with zeros to a whole byte.
+const (
+	postgresVersion = 1
+
+	postgresTypeEmpty    = 1
+	postgresTypeExplicit = 2
+	postgresTypeSparse   = 3
+	postgresTypeFull     = 4
+
+	postgresSparseOn      = 0x40
+	postgresExplicitAuto  = 63 // The explicit threshold cutoff that means "automatic".
+	postgresMaxRegWidth   = 8
+	postgresMaxExplicitLg = 62
+)
+
+var (
+	// ErrInvalidPostgres is matched (using errors.Is) by the errors returned when UnmarshalPostgres
+	// is given a buffer that isn't a postgresql-hll sketch, or when MarshalPostgres is given
+	// invalid PostgresOptions.
+	ErrInvalidPostgres = errors.New("hll: invalid postgresql-hll sketch")
+
+	// ErrPostgresLossy is matched (using errors.Is) by the errors returned when a sketch can't be
+	// converted to or from a postgresql-hll sketch without losing information.
+	ErrPostgresLossy = errors.New("hll: lossy postgresql-hll conversion")
+)
+
+// PostgresOptions are the parameters of a postgresql-hll sketch that don't come from the Hll. The
+// log2m parameter is always p. postgresql-hll only combines sketches whose parameters are all the
+// same.
+type PostgresOptions struct {
+	RegWidth          uint // The number of bits in a register, from 1 to 8.
+	ExplicitThreshold int  // -1 for automatic, 0 to disable EXPLICIT sketches, or a power of two.
+	SparseOn          bool // Whether SPARSE sketches are allowed.
+}
+
+// DefaultPostgresOptions are the defaults of postgresql-hll: regwidth=5, expthresh=-1, sparseon=1.
+var DefaultPostgresOptions = PostgresOptions{RegWidth: 5, ExplicitThreshold: -1, SparseOn: true}
+
+// PostgresHasherName is the prefix of the HashID names of PostgresHasher. The name also holds
+// log2m, since it decides how the hash is rearranged.
+const PostgresHasherName = "postgres-hll"
+
+// PostgresHasher hashes inputs like postgresql-hll's hll_hash_bytea, hll_hash_text and so on do with
+// the given seed: it's the first 64 bits of MurmurHash3 x64 128. postgresql-hll takes the register
+// index from the low log2m bits of the hash, and counts the trailing zeros of the rest. Sum64
+// rotates the hash so that the index bits are at the top, which is how an Hll with p=log2m
+// expects them.
+//
+// Use it for sketches that will be combined with postgresql-hll sketches; see UnmarshalPostgres.
+type PostgresHasher struct {
+	Log2m uint
+	Seed  uint32
+}
+
+// Sum64 returns the rotated hash of b.
+func (x PostgresHasher) Sum64(b []byte) uint64 {
+	h1, _ := murmur3Sum128(b, x.Seed)
+	return bits.RotateLeft64(h1, -int(x.Log2m))
+}
+
+// HashID returns the HashID with the name PostgresHasherName/log2m=<Log2m> and x's seed.
+func (x PostgresHasher) HashID() HashID {
+	return HashID{postgresHasherName(x.Log2m), uint64(x.Seed)}
+}
+
+func postgresHasherName(log2m uint) string {
+	return fmt.Sprintf("%s/log2m=%d", PostgresHasherName, log2m)
+}
+
+func init() {
+	for log2m := uint(minP); log2m <= maxP; log2m++ {
+		log2m := log2m
+		RegisterHasher(postgresHasherName(log2m), func(seed uint64) Hasher {
+			return PostgresHasher{log2m, uint32(seed)}
+		})
+	}
+}
+
+// UnmarshalPostgres replaces h with the postgresql-hll sketch in buf, which is the binary value of
+// an hll column. The result has p=log2m and the default pPrime. Its hash function isn't known,
+// since postgresql-hll doesn't record it. If the sketch was built from hll_hash_* values, use
+// SetHasher with the matching PostgresHasher before adding to it.
+//
+// An EMPTY sketch becomes a sparse sketch. The others become dense sketches with the registers
+// that postgresql-hll has: an EXPLICIT sketch's registers are set from its hashes the way
+// postgresql-hll sets them when it promotes the sketch, and SPARSE and FULL sketches keep theirs.
+//
+// The conversion is lossless, with these exceptions, for which an error that wraps
+// ErrPostgresLossy is returned:
+//   - An Hll has 4 to 18 bits of precision, so log2m must be in that range.
+//   - An Hll register has 6 bits, so no register may be larger than 63. That's only possible with
+//     a regwidth of 7 or 8, and even then the registers that hashes produce are smaller.
+//
+// It returns an error that wraps ErrInvalidPostgres if buf isn't a valid sketch.
+func (h *Hll) UnmarshalPostgres(buf []byte) error {
+	if len(buf) < 3 {
+		return fmt.Errorf("%w: %d bytes is too short for the header", ErrInvalidPostgres, len(buf))
+	}
+	if version := buf[0] >> 4; version != postgresVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidPostgres, version)
+	}
+	typ, log2m, regWidth := buf[0]&0x0f, uint(buf[1]&0x1f), uint(buf[1]>>5)+1
+	if _, err := decodePostgresCutoff(buf[2]); err != nil {
+		return err
+	}
+	if log2m < minP || log2m > maxP {
+		return fmt.Errorf("%w: log2m=%d is outside of [%d,%d]", ErrPostgresLossy, log2m, minP, maxP)
+	}
+	data := buf[3:]
+
+	decoded, err := New(WithP(log2m))
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case postgresTypeEmpty:
+		if len(data) != 0 {
+			return fmt.Errorf("%w: %d bytes of data in an EMPTY sketch", ErrInvalidPostgres,
+				len(data))
+		}
+	case postgresTypeExplicit:
+		if len(data)%8 != 0 {
+			return fmt.Errorf("%w: EXPLICIT data of %d bytes", ErrInvalidPostgres, len(data))
+		}
+		// The sparse list doesn't keep the bits of a hash that postgresql-hll counts the zeros
+		// of, so the hashes aren't added to it.
+		decoded.switchToNormal()
+		maxVal := uint64(1)<<regWidth - 1
+		for ; len(data) > 0; data = data[8:] {
+			idx, val := postgresRegister(binary.BigEndian.Uint64(data), log2m)
+			if val != 0 {
+				decoded.maxRegister(idx, uint8(minU64(val, maxVal)))
+			}
+		}
+	case postgresTypeSparse:
+		decoded.switchToNormal()
+		entryBits := log2m + regWidth
+		for offset := uint64(0); offset+uint64(entryBits) <= uint64(len(data))*8; offset += uint64(entryBits) {
+			entry := getBigEndianBits(data, offset, entryBits)
+			idx, val := entry>>regWidth, entry&(1<<regWidth-1)
+			// The padding may look like an entry, but registers that are zero aren't stored.
+			if val == 0 {
+				continue
+			}
+			if err := decoded.setPostgresRegister(idx, val); err != nil {
+				return err
+			}
+		}
+	case postgresTypeFull:
+		if expected := (decoded.m*uint64(regWidth) + 7) / 8; uint64(len(data)) != expected {
+			return fmt.Errorf("%w: FULL data of %d bytes, expected %d", ErrInvalidPostgres,
+				len(data), expected)
+		}
+		decoded.switchToNormal()
+		for idx := uint64(0); idx < decoded.m; idx++ {
+			val := getBigEndianBits(data, idx*uint64(regWidth), regWidth)
+			if err := decoded.setPostgresRegister(idx, val); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%w: unsupported type %d", ErrInvalidPostgres, typ)
+	}
+
+	*h = *decoded
+	return nil
+}
+
+// Returns the register that postgresql-hll sets for the hash x, and the value it sets it to before
+// capping it at the largest value of the regwidth. The index is the low log2m bits of x, and the
+// value is the number of trailing zeros of the other bits plus one, or zero if they're all zero.
+func postgresRegister(x uint64, log2m uint) (idx, val uint64) {
+	idx = x & (1<<log2m - 1)
+	if rest := x >> log2m; rest != 0 {
+		val = uint64(bits.TrailingZeros64(rest)) + 1
+	}
+	return idx, val
+}
+
+func (h *Hll) setPostgresRegister(idx, val uint64) error {
+	if val > 63 {
+		return fmt.Errorf("%w: register %d is %d, which doesn't fit in 6 bits", ErrPostgresLossy,
+			idx, val)
+	}
+	h.maxRegister(idx, uint8(val))
+	return nil
+}
+
+// MarshalPostgres returns h as a postgresql-hll sketch with log2m=p and the given options. It's a
+// SPARSE sketch if opts allow it and it's smaller than the FULL sketch, and otherwise a FULL one,
+// or an EMPTY one if all of the registers are zero. It's never an EXPLICIT sketch, because an Hll
+// doesn't keep the whole hashes.
+//
+// A register larger than regwidth bits can hold is capped at the largest value that they can, as
+// postgresql-hll caps it when it adds a hash.
+//
+// h must use a PostgresHasher with Log2m=p, or an unknown hash function, otherwise a
+// *HashMismatchError is returned. Only a dense or empty h can be exported: the sparse list doesn't
+// keep the bits that postgresql-hll counts the zeros of for most hashes, so for a sparse h that
+// isn't empty, an error that wraps ErrPostgresLossy is returned.
+func (h *Hll) MarshalPostgres(opts PostgresOptions) ([]byte, error) {
+	if opts.RegWidth < 1 || opts.RegWidth > postgresMaxRegWidth {
+		return nil, fmt.Errorf("%w: regwidth=%d", ErrInvalidPostgres, opts.RegWidth)
+	}
+	cutoff, err := encodePostgresCutoff(opts)
+	if err != nil {
+		return nil, err
+	}
+	if !h.hashID.IsZero() && h.hashID.Name != postgresHasherName(h.p) {
+		return nil, &HashMismatchError{h.hashID, PostgresHasher{Log2m: h.p}.HashID()}
+	}
+
+	if h.isSparse && (h.sparseList.GetNumElements() > 0 || len(h.tempSet) > 0) {
+		return nil, fmt.Errorf("%w: a sparse sketch doesn't keep the registers' values",
+			ErrPostgresLossy)
+	}
+
+	regs := h.exportRegisters()
+	maxVal := uint8(1<<opts.RegWidth - 1)
+	var numFilled uint64
+	for idx := uint64(0); idx < h.m; idx++ {
+		if regs.Get(idx) != 0 {
+			numFilled++
+		}
+	}
+
+	regWidth, log2m := uint64(opts.RegWidth), uint64(h.p)
+	header := []byte{0, byte(regWidth-1)<<5 | byte(log2m), cutoff}
+	fullBytes := (h.m*regWidth + 7) / 8
+	sparseBytes := (numFilled*(log2m+regWidth) + 7) / 8
+	switch {
+	case numFilled == 0:
+		header[0] = postgresVersion<<4 | postgresTypeEmpty
+		return header, nil
+	case opts.SparseOn && sparseBytes < fullBytes:
+		header[0] = postgresVersion<<4 | postgresTypeSparse
+		buf := append(header, make([]byte, sparseBytes)...)
+		var offset uint64
+		for idx := uint64(0); idx < h.m; idx++ {
+			if val := uint64(minU8(regs.Get(idx), maxVal)); val != 0 {
+				putBigEndianBits(buf[3:], offset, uint(log2m+regWidth), idx<<regWidth|val)
+				offset += log2m + regWidth
+			}
+		}
+		return buf, nil
+	default:
+		header[0] = postgresVersion<<4 | postgresTypeFull
+		buf := append(header, make([]byte, fullBytes)...)
+		for idx := uint64(0); idx < h.m; idx++ {
+			val := minU8(regs.Get(idx), maxVal)
+			putBigEndianBits(buf[3:], idx*regWidth, uint(regWidth), uint64(val))
+		}
+		return buf, nil
+	}
+}
+
+// ParsePostgresOptions returns the options of the postgresql-hll sketch in buf, so that a sketch
+// can be marshaled again with the same options.
+func ParsePostgresOptions(buf []byte) (PostgresOptions, error) {
+	if len(buf) < 3 {
+		return PostgresOptions{}, fmt.Errorf("%w: %d bytes is too short for the header",
+			ErrInvalidPostgres, len(buf))
+	}
+	opts, err := decodePostgresCutoff(buf[2])
+	opts.RegWidth = uint(buf[1]>>5) + 1
+	return opts, err
+}
+
+// Returns the options in the cutoff byte, other than the register width.
+func decodePostgresCutoff(cutoff byte) (PostgresOptions, error) {
+	if cutoff&0x80 != 0 {
+		return PostgresOptions{}, fmt.Errorf("%w: reserved bit of the cutoff byte is set",
+			ErrInvalidPostgres)
+	}
+	opts := PostgresOptions{SparseOn: cutoff&postgresSparseOn != 0}
+	switch lg := cutoff & 0x3f; lg {
+	case 0:
+		opts.ExplicitThreshold = 0
+	case postgresExplicitAuto:
+		opts.ExplicitThreshold = -1
+	default:
+		opts.ExplicitThreshold = 1 << (lg - 1)
+	}
+	return opts, nil
+}
+
+func encodePostgresCutoff(opts PostgresOptions) (byte, error) {
+	var cutoff byte
+	if opts.SparseOn {
+		cutoff = postgresSparseOn
+	}
+	switch t := opts.ExplicitThreshold; {
+	case t == -1:
+		cutoff |= postgresExplicitAuto
+	case t == 0:
+	case t > 0 && t&(t-1) == 0 && bits.Len(uint(t)) <= postgresMaxExplicitLg:
+		cutoff |= byte(bits.Len(uint(t)))
+	default:
+		return 0, fmt.Errorf("%w: explicit threshold %d", ErrInvalidPostgres, t)
+	}
+	return cutoff, nil
+}
+
+// Returns the width bits of buf that start at bit offset, where bit 0 is the most significant bit
+// of buf[0].
+func getBigEndianBits(buf []byte, offset uint64, width uint) uint64 {
+	var v uint64
+	for bit := offset; bit < offset+uint64(width); bit++ {
+		v = v<<1 | uint64(buf[bit/8]>>(7-bit%8)&1)
+	}
+	return v
+}
+
+// Sets the width bits of buf that start at bit offset to v. The bits must be zero.
+func putBigEndianBits(buf []byte, offset uint64, width uint, v uint64) {
+	for i := uint(0); i < width; i++ {
+		bit := offset + uint64(i)
+		buf[bit/8] |= byte(v>>(width-1-i)&1) << (7 - bit%8)
+	}
+}
+
+// MurmurHash3 x64 128, as used by postgresql-hll.
+func murmur3Sum128(b []byte, seed uint32) (uint64, uint64) {
+	const c1, c2 = 0x87c37b91114253d5, 0x4cf5ad432745937f
+
+	n := len(b)
+	h1, h2 := uint64(seed), uint64(seed)
+	for ; len(b) >= 16; b = b[16:] {
+		k1, k2 := binary.LittleEndian.Uint64(b), binary.LittleEndian.Uint64(b[8:])
+		h1 ^= bits.RotateLeft64(k1*c1, 31) * c2
+		h1 = (bits.RotateLeft64(h1, 27)+h2)*5 + 0x52dce729
+		h2 ^= bits.RotateLeft64(k2*c2, 33) * c1
+		h2 = (bits.RotateLeft64(h2, 31)+h1)*5 + 0x38495ab5
+	}
+
+	var k1, k2 uint64
+	for i := len(b) - 1; i >= 8; i-- {
+		k2 ^= uint64(b[i]) << (8 * uint(i-8))
+	}
+	if len(b) > 8 {
+		h2 ^= bits.RotateLeft64(k2*c2, 33) * c1
+	}
+	for i := minInt(len(b), 8) - 1; i >= 0; i-- {
+		k1 ^= uint64(b[i]) << (8 * uint(i))
+	}
+	if len(b) > 0 {
+		h1 ^= bits.RotateLeft64(k1*c1, 31) * c2
+	}
+
+	h1 ^= uint64(n)
+	h2 ^= uint64(n)
+	h1 += h2
+	h2 += h1
+	h1, h2 = fmix64(h1), fmix64(h2)
+	h1 += h2
+	h2 += h1
+	return h1, h2
+}
+
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
+func minInt(x, y int) int {
+	if x <= y {
+		return x
+	}
+	return y
+}
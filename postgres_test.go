@@ -0,0 +1,211 @@
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/bits"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestMurmur3Sum128(t *testing.T) {
+	testCases := []struct {
+		input    string
+		seed     uint32
+		expected uint64
+	}{
+		{"", 0, 0},
+		{"hello", 0, 0xcbd8a7b341bd9b02},
+		{"The quick brown fox jumps over the lazy dog", 0, 0xe34bbc7bbc071b6c},
+	}
+
+	for i, testCase := range testCases {
+		actual, _ := murmur3Sum128([]byte(testCase.input), testCase.seed)
+		assert.Equalf(t, actual, testCase.expected, "Testcase %d: %#x", i, actual)
+	}
+}
+
+// The fixtures are postgresql-hll sketches with log2m=11, regwidth=5 and the default cutoff byte,
+// of hll_hash_text('elem:0') to hll_hash_text('elem:<count-1>').
+var postgresFixtures = []struct {
+	file  string
+	count int
+	typ   byte
+}{
+	{"testdata/postgres-empty.hll", 0, postgresTypeEmpty},
+	{"testdata/postgres-explicit.hll", 50, postgresTypeExplicit},
+	{"testdata/postgres-sparse.hll", 300, postgresTypeSparse},
+	{"testdata/postgres-full.hll", 20000, postgresTypeFull},
+}
+
+func TestUnmarshalPostgres(t *testing.T) {
+	for _, fixture := range postgresFixtures {
+		buf, err := ioutil.ReadFile(fixture.file)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, buf[0]&0x0f, fixture.typ)
+
+		h := &Hll{}
+		assert.Equal(t, h.UnmarshalPostgres(buf), nil)
+		assert.Equal(t, h.p, uint(11))
+		assert.Equal(t, h.HashID(), HashID{})
+
+		expected, err := New(WithP(11), WithHasher(PostgresHasher{Log2m: 11}))
+		assert.Equal(t, nil, err)
+		if fixture.typ != postgresTypeEmpty {
+			expected.switchToNormal()
+		}
+		for i := 0; i < fixture.count; i++ {
+			expected.AddString(fmt.Sprintf("elem:%d", i))
+		}
+		assert.Equalf(t, h.isSparse, expected.isSparse, "%s", fixture.file)
+		assert.Equalf(t, h.readOnlyRegisters(), expected.readOnlyRegisters(), "%s", fixture.file)
+		assert.Equalf(t, h.Cardinality(), expected.Cardinality(), "%s", fixture.file)
+
+		card := float64(h.Cardinality())
+		assert.Tf(t, card >= 0.95*float64(fixture.count) && card <= 1.05*float64(fixture.count),
+			"%s: cardinality %v", fixture.file, card)
+
+		// Exporting gives back the same sketch, except that EXPLICIT sketches become SPARSE ones.
+		opts, err := ParsePostgresOptions(buf)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, opts, DefaultPostgresOptions)
+		exported, err := h.MarshalPostgres(opts)
+		assert.Equal(t, nil, err)
+		if fixture.typ == postgresTypeExplicit {
+			// postgresql-hll takes the index from the low log2m bits of a hash, and the value
+			// from the trailing zeros of the rest.
+			rule := make([]uint8, h.m)
+			for data := buf[3:]; len(data) > 0; data = data[8:] {
+				x := binary.BigEndian.Uint64(data)
+				if idx, rest := x&(1<<11-1), x>>11; rest != 0 {
+					rule[idx] = maxU8(rule[idx], uint8(bits.TrailingZeros64(rest)+1))
+				}
+			}
+			assert.Equal(t, exported[0], byte(postgresVersion<<4|postgresTypeSparse))
+			rt := &Hll{}
+			assert.Equal(t, rt.UnmarshalPostgres(exported), nil)
+			for idx, val := range rule {
+				assert.Equalf(t, h.bigM.Get(uint64(idx)), val, "register %d", idx)
+				assert.Equalf(t, rt.bigM.Get(uint64(idx)), val, "register %d", idx)
+			}
+		} else {
+			assert.Equalf(t, exported, buf, "%s", fixture.file)
+		}
+	}
+}
+
+func TestMarshalPostgres(t *testing.T) {
+	// A sparse sketch doesn't keep the values of its registers, unless it's empty.
+	sparse, err := New(WithP(11), WithHasher(PostgresHasher{Log2m: 11}))
+	assert.Equal(t, nil, err)
+	buf, err := sparse.MarshalPostgres(DefaultPostgresOptions)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, buf[0], byte(postgresVersion<<4|postgresTypeEmpty))
+	sparse.AddString("elem:0")
+	assert.T(t, sparse.isSparse)
+	_, err = sparse.MarshalPostgres(DefaultPostgresOptions)
+	assert.T(t, errors.Is(err, ErrPostgresLossy))
+
+	h, err := New(WithP(11), WithHasher(PostgresHasher{Log2m: 11, Seed: 7}))
+	assert.Equal(t, nil, err)
+	for i := 0; i < 20000; i++ {
+		h.AddString(fmt.Sprintf("elem:%d", i))
+	}
+
+	// Without sparseon, a sketch is always FULL.
+	buf, err = h.MarshalPostgres(PostgresOptions{RegWidth: 6, ExplicitThreshold: 1024})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, buf[:3], []byte{postgresVersion<<4 | postgresTypeFull, 5<<5 | 11, 11})
+	rt := &Hll{}
+	assert.Equal(t, rt.UnmarshalPostgres(buf), nil)
+	assert.Equal(t, rt.readOnlyRegisters(), h.readOnlyRegisters())
+	opts, err := ParsePostgresOptions(buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, opts, PostgresOptions{RegWidth: 6, ExplicitThreshold: 1024})
+
+	// A register that doesn't fit in regwidth bits is capped, as postgresql-hll caps it.
+	assert.T(t, !h.isSparse)
+	h.maxRegister(5, 40)
+	buf, err = h.MarshalPostgres(PostgresOptions{RegWidth: 3})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, rt.UnmarshalPostgres(buf), nil)
+	capped := 0
+	for idx := uint64(0); idx < h.m; idx++ {
+		val := h.bigM.Get(idx)
+		if val > 7 {
+			capped++
+		}
+		assert.Equalf(t, rt.bigM.Get(idx), minU8(val, 7), "register %d", idx)
+	}
+	assert.T(t, capped > 1)
+	small := NewHll(11, 25)
+	small.switchToNormal()
+	small.maxRegister(9, 40)
+	buf, err = small.MarshalPostgres(DefaultPostgresOptions)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, buf[0], byte(postgresVersion<<4|postgresTypeSparse))
+	assert.Equal(t, rt.UnmarshalPostgres(buf), nil)
+	assert.Equal(t, rt.bigM.Get(9), uint8(31))
+
+	for _, opts := range []PostgresOptions{
+		{RegWidth: 0},
+		{RegWidth: 9},
+		{RegWidth: 5, ExplicitThreshold: 3},
+		{RegWidth: 5, ExplicitThreshold: -2},
+	} {
+		_, err = h.MarshalPostgres(opts)
+		assert.Tf(t, errors.Is(err, ErrInvalidPostgres), "%+v: %v", opts, err)
+	}
+
+	h, err = New(WithP(12), WithHasher(PostgresHasher{Log2m: 11}))
+	assert.Equal(t, nil, err)
+	_, err = h.MarshalPostgres(DefaultPostgresOptions)
+	assert.T(t, errors.Is(err, ErrHashMismatch))
+	h, err = New(WithP(11), WithHasher(XXHash64{}))
+	assert.Equal(t, nil, err)
+	_, err = h.MarshalPostgres(DefaultPostgresOptions)
+	assert.T(t, errors.Is(err, ErrHashMismatch))
+
+	// PostgresHasher's HashID can be found again when the sketch is unmarshaled.
+	h, err = New(WithP(11), WithHasher(PostgresHasher{Log2m: 11, Seed: 7}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, lookupHasher(h.HashID()), Hasher(PostgresHasher{Log2m: 11, Seed: 7}))
+}
+
+func TestUnmarshalPostgresErrors(t *testing.T) {
+	testCases := []struct {
+		buf      string
+		expected error
+	}{
+		{"", ErrInvalidPostgres},
+		{"\x11\x8b", ErrInvalidPostgres},
+		{"\x21\x8b\x7f", ErrInvalidPostgres},             // Unsupported version
+		{"\x15\x8b\x7f", ErrInvalidPostgres},             // Unsupported type
+		{"\x11\x8b\xff", ErrInvalidPostgres},             // Reserved bit
+		{"\x11\x8b\x7f\x00", ErrInvalidPostgres},         // Data in an EMPTY sketch
+		{"\x12\x8b\x7f\x00\x00\x00", ErrInvalidPostgres}, // Partial hash
+		{"\x14\x8b\x7f\x00\x00\x00", ErrInvalidPostgres}, // Short FULL sketch
+		{"\x11\x83\x7f", ErrPostgresLossy},               // log2m=3
+		{"\x11\x93\x7f", ErrPostgresLossy},               // log2m=19
+		{"\x13\xe4\x7f\x24\x00", ErrPostgresLossy},       // Register 2 of 64, with regwidth=8
+	}
+	for i, testCase := range testCases {
+		h := &Hll{}
+		err := h.UnmarshalPostgres([]byte(testCase.buf))
+		assert.Tf(t, errors.Is(err, testCase.expected), "Testcase %d: %v", i, err)
+	}
+}
+
+func TestPostgresBits(t *testing.T) {
+	buf := make([]byte, 4)
+	for i := uint64(0); i < 6; i++ {
+		putBigEndianBits(buf, i*5, 5, i+26)
+	}
+	for i := uint64(0); i < 6; i++ {
+		assert.Equal(t, getBigEndianBits(buf, i*5, 5), i+26)
+	}
+	assert.Equal(t, buf, []byte{0xd6, 0xf9, 0xdf, 0x7c})
+}
@@ -0,0 +1,265 @@
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Redis HyperLogLogs (the strings written by PFADD) always have 2^14 registers. They're stored with
+// a 16-byte header: the magic "HYLL", an encoding byte, 3 unused bytes and a cached cardinality,
+// which is 8 little-endian bytes whose top bit is set when the cache is stale.
+//
+// The dense encoding is the 6-bit registers, packed from the least significant bit of each byte:
+// register i starts at bit 6*i. The sparse encoding is a sequence of run-length opcodes:
+//
+//	00xxxxxx           xxxxxx+1 registers are zero
+//	01xxxxxx yyyyyyyy  xxxxxxyyyyyyyy+1 registers are zero
+//	1vvvvvxx           xx+1 registers have the value vvvvv+1
+const (
+	redisP          = 14
+	redisRegisters  = 1 << redisP
+	redisHeaderSize = 16
+	redisDenseSize  = redisHeaderSize + redisRegisters*6/8
+
+	redisEncodingDense  = 0
+	redisEncodingSparse = 1
+
+	redisSparseMaxValue   = 32
+	redisSparseMaxValLen  = 4
+	redisSparseMaxZeroLen = 64
+	redisSparseMaxBytes   = 3000 // The default hll-sparse-max-bytes of the Redis server.
+)
+
+var redisMagic = []byte("HYLL")
+
+// ErrInvalidRedis is matched (using errors.Is) by the errors returned when UnmarshalRedis is given
+// a buffer that isn't a Redis HyperLogLog.
+var ErrInvalidRedis = errors.New("hll: invalid Redis HyperLogLog")
+
+// RedisHasherName is the HashID name of RedisHasher.
+const RedisHasherName = "redis"
+
+// RedisHasher is the hash function of Redis's HyperLogLogs, MurmurHash64A with the seed 0xadc83b19.
+// Redis takes the register index from the low 14 bits of the hash, and counts the trailing zeros of
+// the rest. Sum64 moves the 14 index bits to the top of the hash, so that an Hll with p=14 adds an
+// input to the register that PFADD would, and with the same value, unless the other 50 bits of the
+// hash are all zero.
+//
+// Use it for sketches that will be combined with Redis HyperLogLogs; see UnmarshalRedis.
+type RedisHasher struct{}
+
+// Sum64 returns the rearranged MurmurHash64A of b.
+func (RedisHasher) Sum64(b []byte) uint64 {
+	x := murmurHash64A(b, 0xadc83b19)
+	return x<<(64-redisP) | x>>redisP
+}
+
+// HashID returns the HashID with the name RedisHasherName.
+func (RedisHasher) HashID() HashID {
+	return HashID{RedisHasherName, 0}
+}
+
+// MurmurHash64A, as used by Redis.
+func murmurHash64A(b []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ uint64(len(b))*m
+	for ; len(b) >= 8; b = b[8:] {
+		k := binary.LittleEndian.Uint64(b)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+	if len(b) > 0 {
+		for i := len(b) - 1; i >= 0; i-- {
+			h ^= uint64(b[i]) << (8 * uint(i))
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// UnmarshalRedis replaces h with the Redis HyperLogLog in buf, which is the value of a Redis key that
+// was written by PFADD or PFMERGE (as returned by GET or DUMP, without DUMP's trailer). Either
+// encoding is accepted. The result is a dense sketch with p=14, the default pPrime, and the HashID
+// of RedisHasher, so it can only be combined with sketches that use RedisHasher or whose hash
+// function isn't known. Its registers are those of the Redis HyperLogLog; the cached cardinality
+// is ignored.
+//
+// It returns an error that wraps ErrInvalidRedis if buf isn't a valid Redis HyperLogLog.
+func (h *Hll) UnmarshalRedis(buf []byte) error {
+	if len(buf) < redisHeaderSize || string(buf[:len(redisMagic)]) != string(redisMagic) {
+		return fmt.Errorf("%w: no HYLL header", ErrInvalidRedis)
+	}
+	regs := newNormal(redisRegisters)
+	switch encoding := buf[len(redisMagic)]; encoding {
+	case redisEncodingDense:
+		if len(buf) != redisDenseSize {
+			return fmt.Errorf("%w: dense encoding of %d bytes, expected %d", ErrInvalidRedis,
+				len(buf), redisDenseSize)
+		}
+		dense := buf[redisHeaderSize:]
+		for i := uint64(0); i < redisRegisters; i++ {
+			regs.Set(i, getRedisRegister(dense, i))
+		}
+	case redisEncodingSparse:
+		if err := readRedisSparse(buf[redisHeaderSize:], regs); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: unknown encoding %d", ErrInvalidRedis, encoding)
+	}
+
+	decoded, err := New(WithP(redisP), WithHasher(RedisHasher{}))
+	if err != nil {
+		return err
+	}
+	decoded.isSparse = false
+	decoded.sparseList = nil
+	decoded.bigM = regs
+	decoded.hist = regs.histogram(decoded.m)
+	*h = *decoded
+	return nil
+}
+
+// Reads the sparse opcodes into the registers, which must all be zero.
+func readRedisSparse(ops []byte, regs normal) error {
+	var idx uint64
+	for len(ops) > 0 {
+		var runLen uint64
+		var val uint8
+		switch op := ops[0]; {
+		case op&0xc0 == 0x00:
+			runLen = uint64(op&0x3f) + 1
+			ops = ops[1:]
+		case op&0xc0 == 0x40:
+			if len(ops) < 2 {
+				return fmt.Errorf("%w: truncated sparse opcode", ErrInvalidRedis)
+			}
+			runLen = uint64(op&0x3f)<<8 | uint64(ops[1]) + 1
+			ops = ops[2:]
+		default:
+			val = (op>>2)&0x1f + 1
+			runLen = uint64(op&0x03) + 1
+			ops = ops[1:]
+		}
+		if idx+runLen > redisRegisters {
+			return fmt.Errorf("%w: sparse opcodes describe more than %d registers", ErrInvalidRedis,
+				redisRegisters)
+		}
+		for end := idx + runLen; idx < end; idx++ {
+			regs.Set(idx, val)
+		}
+	}
+	if idx != redisRegisters {
+		return fmt.Errorf("%w: sparse opcodes describe %d registers, expected %d", ErrInvalidRedis,
+			idx, redisRegisters)
+	}
+	return nil
+}
+
+// MarshalRedis returns h as a Redis HyperLogLog, which can be stored in a Redis key with SET or
+// RESTORE and then used with PFCOUNT, PFADD and PFMERGE. It uses Redis's sparse encoding when every
+// register fits in it and the result is within Redis's default hll-sparse-max-bytes, and the dense
+// encoding otherwise. The cached cardinality is marked as stale, so Redis computes its own.
+//
+// h must have p=14, otherwise a *PrecisionMismatchError is returned, and must use RedisHasher or
+// an unknown hash function, otherwise a *HashMismatchError is returned.
+//
+// A sparse sketch sets the same registers that PFADD would, except for any that its sparse list
+// dropped, but it doesn't keep the bits that Redis counts the zeros of for most hashes. Those
+// registers are exported as 1, the least that PFADD could have set, so the result is never larger
+// than what PFADD gives, and PFMERGE with Redis's own HyperLogLog of the same strings gives Redis's
+// HyperLogLog.
+func (h *Hll) MarshalRedis() ([]byte, error) {
+	if h.p != redisP {
+		return nil, &PrecisionMismatchError{h.p, h.pPrime, redisP, h.pPrime}
+	}
+	if err := checkHashIDs(h.hashID, RedisHasher{}.HashID()); err != nil {
+		return nil, err
+	}
+	regs := h.exportRegisters()
+
+	if buf, ok := appendRedisSparse(newRedisHeader(redisEncodingSparse), regs); ok {
+		return buf, nil
+	}
+	buf := append(newRedisHeader(redisEncodingDense), make([]byte, redisDenseSize-redisHeaderSize)...)
+	dense := buf[redisHeaderSize:]
+	for i := uint64(0); i < redisRegisters; i++ {
+		setRedisRegister(dense, i, regs.Get(i))
+	}
+	return buf, nil
+}
+
+// Returns the header of a Redis HyperLogLog with the given encoding. The cached cardinality is
+// marked as stale.
+func newRedisHeader(encoding byte) []byte {
+	header := make([]byte, redisHeaderSize)
+	copy(header, redisMagic)
+	header[len(redisMagic)] = encoding
+	header[redisHeaderSize-1] = 0x80
+	return header
+}
+
+// Appends the sparse opcodes of the registers to buf. It returns false if a register is too large
+// for the sparse encoding, or the result would be too large.
+func appendRedisSparse(buf []byte, regs registers) ([]byte, bool) {
+	for idx := uint64(0); idx < redisRegisters; {
+		val := regs.Get(idx)
+		if val > redisSparseMaxValue {
+			return nil, false
+		}
+		runLen := uint64(1)
+		for idx+runLen < redisRegisters && regs.Get(idx+runLen) == val {
+			runLen++
+		}
+		idx += runLen
+
+		for runLen > 0 {
+			switch {
+			case val != 0:
+				n := minU64(runLen, redisSparseMaxValLen)
+				buf = append(buf, 0x80|(val-1)<<2|byte(n-1))
+				runLen -= n
+			case runLen <= redisSparseMaxZeroLen:
+				buf = append(buf, byte(runLen-1))
+				runLen = 0
+			default:
+				// A run of zeros can't be longer than the number of registers.
+				buf = append(buf, 0x40|byte((runLen-1)>>8), byte(runLen-1))
+				runLen = 0
+			}
+		}
+		if len(buf) > redisSparseMaxBytes {
+			return nil, false
+		}
+	}
+	return buf, true
+}
+
+// Returns the 6-bit register i of the dense registers of a Redis HyperLogLog.
+func getRedisRegister(dense []byte, i uint64) uint8 {
+	bit := i * 6
+	v := uint16(dense[bit/8])
+	if bit/8+1 < uint64(len(dense)) {
+		v |= uint16(dense[bit/8+1]) << 8
+	}
+	return uint8(v>>(bit%8)) & 0x3f
+}
+
+// Sets the 6-bit register i of the dense registers of a Redis HyperLogLog.
+func setRedisRegister(dense []byte, i uint64, val uint8) {
+	bit := i * 6
+	mask, v := uint16(0x3f)<<(bit%8), uint16(val)<<(bit%8)
+	dense[bit/8] = dense[bit/8]&^uint8(mask) | uint8(v)
+	if bit/8+1 < uint64(len(dense)) {
+		dense[bit/8+1] = dense[bit/8+1]&^uint8(mask>>8) | uint8(v>>8)
+	}
+}
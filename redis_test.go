@@ -0,0 +1,179 @@
+package hll
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestMurmurHash64A(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected uint64
+	}{
+		{"", 15627466953755236146},
+		{"a", 6039968161137406375},
+		{"elem:12345678", 3769094617182337259},
+	}
+
+	for i, testCase := range testCases {
+		actual := murmurHash64A([]byte(testCase.input), 0xadc83b19)
+		assert.Equalf(t, actual, testCase.expected, "Testcase %d: %d", i, actual)
+	}
+}
+
+// The fixtures are Redis HyperLogLogs of the strings "elem:0" to "elem:<count-1>", as left by
+// PFADD, with stale cached cardinalities.
+var redisFixtures = []struct {
+	file     string
+	count    int
+	encoding byte
+}{
+	{"testdata/redis-sparse.hyll", 200, redisEncodingSparse},
+	{"testdata/redis-dense.hyll", 100000, redisEncodingDense},
+}
+
+// Returns a dense sketch with the registers that PFADD would give the fixture's strings.
+func redisExpected(t *testing.T, count int) *Hll {
+	h, err := New(WithP(14), WithHasher(RedisHasher{}))
+	assert.Equal(t, nil, err)
+	h.switchToNormal()
+	for i := 0; i < count; i++ {
+		h.AddString(fmt.Sprintf("elem:%d", i))
+	}
+	return h
+}
+
+func TestUnmarshalRedis(t *testing.T) {
+	for _, fixture := range redisFixtures {
+		buf, err := ioutil.ReadFile(fixture.file)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, buf[4], fixture.encoding)
+
+		h := &Hll{}
+		assert.Equal(t, h.UnmarshalRedis(buf), nil)
+		expected := redisExpected(t, fixture.count)
+		assert.Equalf(t, h.bigM, expected.bigM, "%s", fixture.file)
+		assert.Equal(t, *h.hist, *expected.hist)
+		assert.Equal(t, h.HashID(), HashID{RedisHasherName, 0})
+
+		card := float64(h.Cardinality())
+		assert.Tf(t, card > 0.97*float64(fixture.count) && card < 1.03*float64(fixture.count),
+			"%s: cardinality %v", fixture.file, card)
+
+		// The sketch can be combined with sketches that use the same hash function.
+		assert.Equal(t, h.CombineE(expected), nil)
+		other, err := New(WithP(14), WithHasher(XXHash64{}))
+		assert.Equal(t, nil, err)
+		assert.T(t, errors.Is(h.CombineE(other), ErrHashMismatch))
+
+		// Exporting gives back the same encoding.
+		exported, err := h.MarshalRedis()
+		assert.Equal(t, nil, err)
+		assert.Equalf(t, exported, buf, "%s", fixture.file)
+	}
+}
+
+func TestMarshalRedis(t *testing.T) {
+	// A sketch that's still sparse sets the registers that PFADD sets, with values that are never
+	// larger, so merging it into the fixture that PFADD wrote gives the fixture back.
+	fixture := redisFixtures[0]
+	fixtureBuf, err := ioutil.ReadFile(fixture.file)
+	assert.Equal(t, nil, err)
+	h, err := New(WithP(14), WithHasher(RedisHasher{}))
+	assert.Equal(t, nil, err)
+	for i := 0; i < fixture.count; i++ {
+		h.AddString(fmt.Sprintf("elem:%d", i))
+	}
+	assert.T(t, h.isSparse)
+	buf, err := h.MarshalRedis()
+	assert.Equal(t, nil, err)
+	assert.T(t, h.isSparse)
+	assert.Equal(t, buf[4], byte(redisEncodingSparse))
+
+	rt := &Hll{}
+	assert.Equal(t, rt.UnmarshalRedis(buf), nil)
+	expected := redisExpected(t, fixture.count)
+	var set, expectedSet int
+	for i := uint64(0); i < redisRegisters; i++ {
+		val, expectedVal := rt.bigM.Get(i), expected.bigM.Get(i)
+		assert.Tf(t, val <= expectedVal, "register %d is %d, expected at most %d", i, val,
+			expectedVal)
+		if val != 0 {
+			set++
+		}
+		if expectedVal != 0 {
+			expectedSet++
+		}
+	}
+	// The sparse list may drop a few hashes whose register index it doesn't tell apart.
+	assert.Tf(t, set >= expectedSet*98/100, "%d of %d registers set", set, expectedSet)
+
+	merged := &Hll{}
+	assert.Equal(t, merged.UnmarshalRedis(fixtureBuf), nil)
+	assert.Equal(t, merged.CombineE(rt), nil)
+	mergedBuf, err := merged.MarshalRedis()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, mergedBuf, fixtureBuf)
+
+	// Registers that are too large for the sparse encoding need the dense encoding.
+	h.switchToNormal()
+	h.bigM.Set(5, redisSparseMaxValue+1)
+	buf, err = h.MarshalRedis()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, buf[4], byte(redisEncodingDense))
+	assert.Equal(t, rt.UnmarshalRedis(buf), nil)
+	assert.Equal(t, rt.bigM, h.bigM)
+
+	// An empty sketch is a single XZERO opcode, like the value of a new Redis key.
+	buf, err = NewHll(14, 25).MarshalRedis()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, string(buf), string(newRedisHeader(redisEncodingSparse))+"\x7f\xff")
+
+	_, err = NewHll(12, 25).MarshalRedis()
+	assert.T(t, errors.Is(err, ErrPrecisionMismatch))
+	h, err = New(WithP(14), WithHasher(XXHash64{}))
+	assert.Equal(t, nil, err)
+	_, err = h.MarshalRedis()
+	assert.T(t, errors.Is(err, ErrHashMismatch))
+}
+
+func TestUnmarshalRedisErrors(t *testing.T) {
+	header := string(newRedisHeader(redisEncodingSparse))
+	testCases := []string{
+		"",
+		"HYLL",
+		"HYLX" + header[4:] + "\x7f\xff",
+		"HYLL\x02" + header[5:] + "\x7f\xff", // Unknown encoding
+		"HYLL\x00" + header[5:] + "\x00",     // Short dense encoding
+		header + "\x7f",                      // Truncated XZERO
+		header + "\x7f\xfe",                  // One register short
+		header + "\x7f\xff\x80",              // One register too many
+	}
+	for i, buf := range testCases {
+		h := &Hll{}
+		err := h.UnmarshalRedis([]byte(buf))
+		assert.Tf(t, errors.Is(err, ErrInvalidRedis), "Testcase %d: %v", i, err)
+	}
+
+	// An empty sparse HyperLogLog is a single XZERO opcode.
+	h := &Hll{}
+	assert.Equal(t, h.UnmarshalRedis([]byte(header+"\x7f\xff")), nil)
+	assert.Equal(t, h.Cardinality(), uint64(0))
+}
+
+func TestRedisRegisters(t *testing.T) {
+	dense := make([]byte, redisDenseSize-redisHeaderSize)
+	for i := uint64(0); i < redisRegisters; i++ {
+		setRedisRegister(dense, i, uint8(i%64))
+	}
+	for i := uint64(0); i < redisRegisters; i++ {
+		assert.Equal(t, getRedisRegister(dense, i), uint8(i%64))
+	}
+	// Register 1 has its low 2 bits in the top of the first byte, and register 2 starts at the
+	// fifth bit of the second byte.
+	assert.Equal(t, dense[:2], []byte{0x40, 0x20})
+}
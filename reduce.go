@@ -0,0 +1,129 @@
+package hll
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidReduce is returned when Reduce is asked to increase a precision. Precision can only be
+// lowered, because the discarded hash bits can't be recovered.
+var ErrInvalidReduce = errors.New("hll: cannot reduce to a higher precision")
+
+// Reduce returns a copy of h that has been folded down to the lower precisions newP and newPPrime.
+// The result behaves as if its inputs had been added to a sketch created with those precisions, so
+// it can be combined with such sketches. h isn't modified.
+//
+// In the dense case, each new register is the maximum of the 2^(p-newP) registers that share its
+// leading index bits. Because rho is taken from the low-order bits of the hash, this is exactly the
+// register that adding the same hashes at newP would have produced.
+//
+// In the sparse case, each encoded hash is decoded and re-encoded at the new precision. When
+// newPPrime equals pPrime this is exact for every hash that the sparse list kept (it only keeps one
+// hash per index). When newPPrime is lower, an encoded hash that didn't keep its low-order bits is
+// re-encoded with the smallest rho that's consistent with it, so the result may slightly
+// underestimate.
+//
+// The result uses the default sparse threshold and merge size for newP, and the register layout
+// and checksum of h.
+func (h *Hll) Reduce(newP, newPPrime uint) (*Hll, error) {
+	if newP > h.p || newPPrime > h.pPrime {
+		return nil, fmt.Errorf("%w: from p=%d, pPrime=%d to p=%d, pPrime=%d", ErrInvalidReduce,
+			h.p, h.pPrime, newP, newPPrime)
+	}
+	reduced, err := New(WithP(newP), WithPPrime(newPPrime), WithHasher(h.hasher),
+		WithHashID(h.hashID), withLayout(h.layout), WithChecksum(h.checksum))
+	if err != nil {
+		return nil, err
+	}
+
+	src := h
+	if len(h.tempSet) > 0 {
+		// Merging the temp set would modify h, so work on a copy.
+		src = h.Copy()
+		src.mergeTmpSetIfAny()
+	}
+
+	if src.isSparse {
+		hashCodes := make([]uint64, 0, src.sparseList.GetNumElements())
+		it := src.sparseList.GetIterator()
+		for {
+			k, ok := it()
+			if !ok {
+				break
+			}
+			hashCodes = append(hashCodes, reencodeHash(k, h.pPrime, newP, newPPrime))
+		}
+
+		// Several old indexes may now share an index. Sorting puts the one with the highest rho
+		// first, and merge() keeps only that one.
+		sortHashcodesByIndex(hashCodes, newP, newPPrime)
+		reduced.sparseList = merge(newP, newPPrime, src.sparseList.SizeInBytes(),
+			makeU64SliceIt(hashCodes), makeU64SliceIt(nil))
+		if reduced.sparseList.SizeInBits() > reduced.sparseThresholdBits {
+			reduced.switchToNormal()
+		}
+		return reduced, nil
+	}
+
+	reduced.switchToNormal()
+	shift := h.p - newP
+	for i := uint64(0); i < h.m; i++ {
+		idx := i >> shift
+		reduced.maxRegister(idx, src.bigM.Get(i))
+	}
+	return reduced, nil
+}
+
+// CombineReduce is like CombineE, but it accepts sketches with different precisions. Both inputs
+// are folded down to the smaller of the two p values and the smaller of the two pPrime values
+// using Reduce, and then combined. If h has to be reduced it's replaced by its reduced version;
+// other is never modified by the reduction, though it may be by the combine (see Combine). If an
+// error is returned, h is unchanged.
+func (h *Hll) CombineReduce(other *Hll) error {
+	if err := checkHashIDs(h.hashID, other.hashID); err != nil {
+		return err
+	}
+
+	p, pPrime := minUint(h.p, other.p), minUint(h.pPrime, other.pPrime)
+
+	// h is only replaced once the combine has succeeded.
+	target := h
+	if h.p != p || h.pPrime != pPrime {
+		reduced, err := h.Reduce(p, pPrime)
+		if err != nil {
+			return err
+		}
+		target = reduced
+	}
+	if other.p != p || other.pPrime != pPrime {
+		reduced, err := other.Reduce(p, pPrime)
+		if err != nil {
+			return err
+		}
+		other = reduced
+	}
+	if err := target.CombineE(other); err != nil {
+		return err
+	}
+	if target != h {
+		*h = *target
+	}
+	return nil
+}
+
+// Re-encodes the sparse encoded hash k (encoded with pPrime) at a lower precision. The hash bits
+// that k didn't keep are filled in so that encodeHash(x, p, pPrime) == k; when the low-order bits
+// weren't kept, the lowest one is assumed to be set.
+func reencodeHash(k uint64, pPrime, newP, newPPrime uint) uint64 {
+	var x uint64
+	if k&1 == 1 {
+		x = (k >> 7) << (64 - pPrime)
+		r := uint(extractShift(k, 1, 6))
+		if r <= 64-pPrime { // Otherwise all of the low-order bits were zero.
+			x |= 1 << (r - 1)
+		}
+	} else {
+		x = (k>>1)<<(64-pPrime) | 1
+	}
+	return encodeHash(x, newP, newPPrime)
+}
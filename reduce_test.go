@@ -0,0 +1,123 @@
+package hll
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// Reducing a sparse sketch while keeping pPrime should give exactly the registers that adding the
+// same inputs at the lower p would have given.
+func TestReduceSparse(t *testing.T) {
+	h := NewHll(14, 25)
+	direct := NewHll(10, 25)
+	seen := map[uint64]bool{}
+	for len(seen) < 100 {
+		// The sparse list only keeps one hash per index, so inputs that share an index at the
+		// original p can't be told apart after reducing. Avoid them.
+		x := randUint64(t)
+		if seen[x>>(64-14)] {
+			continue
+		}
+		seen[x>>(64-14)] = true
+		h.Add(x)
+		direct.Add(x)
+	}
+
+	reduced, err := h.Reduce(10, 25)
+	assert.Equal(t, nil, err)
+	direct.mergeTmpSetIfAny()
+	assert.T(t, reduced.isSparse)
+	assert.Equal(t, toNormal(reduced.sparseList, 10, 25), toNormal(direct.sparseList, 10, 25))
+	assert.Equal(t, reduced.Cardinality(), direct.Cardinality())
+
+	// The temp set of h must not have been merged.
+	assert.T(t, len(h.tempSet) > 0)
+}
+
+// Reducing a dense sketch should give exactly the registers that adding the same inputs at the
+// lower p would have given.
+func TestReduceDense(t *testing.T) {
+	h := NewHll(14, 25)
+	h.switchToNormal()
+	direct := NewHll(11, 25)
+	direct.switchToNormal()
+	for _, x := range randUint64s(t, 50000) {
+		h.Add(x)
+		direct.Add(x)
+	}
+
+	reduced, err := h.Reduce(11, 20)
+	assert.Equal(t, nil, err)
+	assert.T(t, !reduced.isSparse)
+	assert.Equal(t, reduced.bigM, direct.bigM)
+	assert.Equal(t, reduced.p, uint(11))
+	assert.Equal(t, reduced.pPrime, uint(20))
+}
+
+func TestReduceInvalid(t *testing.T) {
+	h := NewHll(12, 25)
+
+	_, err := h.Reduce(14, 25)
+	assert.T(t, errors.Is(err, ErrInvalidReduce))
+	_, err = h.Reduce(12, 30)
+	assert.T(t, errors.Is(err, ErrInvalidReduce))
+	_, err = h.Reduce(3, 20)
+	assert.T(t, errors.Is(err, ErrInvalidP))
+}
+
+func TestCombineReduce(t *testing.T) {
+	testCases := []struct {
+		p1, pPrime1, p2, pPrime2 uint
+		count1, count2           int
+	}{
+		{12, 25, 14, 25, 50, 100},
+		{14, 25, 12, 20, 100, 20000},
+		{14, 25, 12, 25, 20000, 30000},
+		{12, 20, 14, 25, 30000, 100},
+	}
+
+	for i, testCase := range testCases {
+		h1 := NewHll(testCase.p1, testCase.pPrime1)
+		for _, x := range randUint64s(t, testCase.count1) {
+			h1.Add(x)
+		}
+		h2 := NewHll(testCase.p2, testCase.pPrime2)
+		for _, x := range randUint64s(t, testCase.count2) {
+			h2.Add(x)
+		}
+
+		err := h1.CombineReduce(h2)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, h1.p, minUint(testCase.p1, testCase.p2))
+		assert.Equal(t, h1.pPrime, minUint(testCase.pPrime1, testCase.pPrime2))
+		assert.Equal(t, h2.p, testCase.p2)
+
+		expectedCard := float64(testCase.count1 + testCase.count2)
+		wrongness := math.Abs(float64(h1.Cardinality())-expectedCard) / expectedCard
+		if wrongness >= 0.1 {
+			t.Errorf("Testcase %d: cardinality wrongness %v was too high", i, wrongness)
+		}
+	}
+}
+
+func TestCombineReduceHashMismatch(t *testing.T) {
+	h1, err := New(WithP(14), WithHasher(XXHash64{1}))
+	assert.Equal(t, nil, err)
+	h2, err := New(WithP(12), WithHasher(XXHash64{2}))
+	assert.Equal(t, nil, err)
+	for i := 0; i < 20000; i++ {
+		h1.AddUint64Value(uint64(i))
+		h2.AddUint64Value(uint64(i))
+	}
+	before := h1.Copy()
+
+	err = h1.CombineReduce(h2)
+	assert.T(t, errors.Is(err, ErrHashMismatch))
+	// The failed combine leaves h1 as it was, at its own precision.
+	assert.Equal(t, h1.p, uint(14))
+	assert.Equal(t, h1.bigM, before.bigM)
+	assert.Equal(t, h1.Cardinality(), before.Cardinality())
+}
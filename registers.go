@@ -0,0 +1,59 @@
+package hll
+
+// registers holds the 2^p registers of the dense representation. The default layout is normal,
+// which packs the 6-bit registers four to three bytes. Whatever the layout, sketches are serialized
+// with the packed registers, so the layout is only a choice of in-memory representation.
+type registers interface {
+	Get(registerIdx uint64) uint8
+	Set(registerIdx uint64, val uint8)
+
+	// Returns a copy of the registers.
+	clone() registers
+
+	// Returns the histogram of the values of the first numRegisters registers.
+	histogram(numRegisters uint64) *registerHist
+
+	// Sets each of the first numRegisters registers to the larger of its value and the value of the
+	// same register in other. The histogram hist, if it's not nil, is updated for every register
+	// that changes.
+	maxMerge(other registers, numRegisters uint64, hist *registerHist)
+
+	// Returns the first numRegisters registers in the packed layout of normal. The result may be
+	// the registers themselves, so it must not be modified.
+	packed(numRegisters uint64) normal
+}
+
+// registerLayout selects the type that holds the registers of the dense representation.
+type registerLayout int
+
+const (
+	packedLayout   registerLayout = iota // normal
+	unpackedLayout                       // unpacked
+	compactLayout                        // compact
+)
+
+// Returns the registers with the given layout that hold the same values as the packed registers n.
+// The result may be n itself.
+func (l registerLayout) fromPacked(n normal, numRegisters uint64) registers {
+	switch l {
+	case unpackedLayout:
+		return unpack(n, numRegisters)
+	case compactLayout:
+		return compactFrom(n, numRegisters)
+	}
+	return n
+}
+
+// The maxMerge of registers that have different layouts, one register at a time.
+func maxMergeRegisters(dst, src registers, numRegisters uint64, hist *registerHist) {
+	for i := uint64(0); i < numRegisters; i++ {
+		old, r := dst.Get(i), src.Get(i)
+		if r > old {
+			dst.Set(i, r)
+			if hist != nil {
+				hist[old]--
+				hist[r]++
+			}
+		}
+	}
+}
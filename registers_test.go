@@ -0,0 +1,98 @@
+package hll
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// The register layouts, and the options that select them.
+var testLayouts = []struct {
+	name   string
+	opts   []Option
+	layout registerLayout
+	typ    string // the type of the registers
+}{
+	{"packed", nil, packedLayout, "hll.normal"},
+	{"unpacked", []Option{WithUnpackedRegisters()}, unpackedLayout, "hll.unpacked"},
+	{"compact", []Option{WithCompactRegisters()}, compactLayout, "*hll.compact"},
+}
+
+func newWithLayout(t *testing.T, p uint, opts []Option) *Hll {
+	h, err := New(append([]Option{WithP(p)}, opts...)...)
+	assert.Equal(t, nil, err)
+	return h
+}
+
+// Whatever its layout, a sketch should hold the same registers as one with packed registers, and
+// serialize identically.
+func TestRegisterLayouts(t *testing.T) {
+	for _, layout := range testLayouts {
+		for _, count := range []int{100, 5000, 100000} {
+			packed := NewHll(12, 25)
+			h := newWithLayout(t, 12, layout.opts)
+			for _, x := range randUint64s(t, count) {
+				packed.Add(x)
+				h.Add(x)
+			}
+
+			assert.Equalf(t, h.Cardinality(), packed.Cardinality(), "%s: count %d", layout.name,
+				count)
+			if !packed.isSparse {
+				assert.Equal(t, fmt.Sprintf("%T", h.bigM), layout.typ)
+				assert.Equal(t, h.bigM.packed(h.m), packed.bigM)
+				assert.Equal(t, *h.hist, *h.bigM.histogram(h.m))
+			}
+
+			jsonPacked, err := json.Marshal(packed)
+			assert.Equal(t, nil, err)
+			jsonH, err := json.Marshal(h)
+			assert.Equal(t, nil, err)
+			assert.Equalf(t, string(jsonH), string(jsonPacked), "%s: count %d", layout.name, count)
+
+			pbPacked, err := packed.MarshalPb()
+			assert.Equal(t, nil, err)
+			pbH, err := h.MarshalPb()
+			assert.Equal(t, nil, err)
+			assert.Equalf(t, pbH, pbPacked, "%s: count %d", layout.name, count)
+
+			// Copies and reductions keep the layout.
+			cp := h.Copy()
+			if cp.isSparse {
+				cp.switchToNormal()
+			}
+			assert.Equal(t, fmt.Sprintf("%T", cp.bigM), layout.typ)
+			reduced, err := h.Reduce(10, 20)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, reduced.layout, layout.layout)
+		}
+	}
+}
+
+func TestCombineLayouts(t *testing.T) {
+	xs, ys := randUint64s(t, 20000), randUint64s(t, 30000)
+	add := func(h *Hll, hashes []uint64) *Hll {
+		for _, x := range hashes {
+			h.Add(x)
+		}
+		return h
+	}
+	expected, err := Union(add(NewHll(12, 25), xs), add(NewHll(12, 25), ys))
+	assert.Equal(t, nil, err)
+
+	for _, layoutA := range testLayouts {
+		for _, layoutB := range testLayouts {
+			a := add(newWithLayout(t, 12, layoutA.opts), xs)
+			b := add(newWithLayout(t, 12, layoutB.opts), ys)
+			union, err := Union(a, b)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, union.layout, layoutA.layout)
+			assert.Equalf(t, union.bigM.packed(union.m), expected.bigM, "%s/%s", layoutA.name,
+				layoutB.name)
+			assert.Equal(t, *union.hist, *expected.hist)
+			assert.Equal(t, union.Cardinality(), expected.Cardinality())
+		}
+	}
+}
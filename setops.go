@@ -0,0 +1,553 @@
+package hll
+
+import (
+	"math"
+)
+
+// IntersectionCardinality estimates the number of unique inputs that were added to both a and b,
+// using the inclusion-exclusion principle: |A∩B| = |A| + |B| - |A∪B|. Neither input is modified. A
+// *PrecisionMismatchError is returned if a and b have different p or pPrime, and a
+// *HashMismatchError if they record different hash functions.
+//
+// The absolute error of this estimate is roughly that of the union estimate, so the relative error
+// can be large when the intersection is small compared to the union. EstimateJoint is usually more
+// accurate.
+func IntersectionCardinality(a, b *Hll) (uint64, error) {
+	union, err := Union(a, b)
+	if err != nil {
+		return 0, err
+	}
+	cardA, cardB := a.readOnlyCardinality(), b.readOnlyCardinality()
+	cardUnion := union.Cardinality()
+
+	if cardA+cardB <= cardUnion {
+		return 0, nil
+	}
+	return minU64(cardA+cardB-cardUnion, minU64(cardA, cardB)), nil
+}
+
+// DifferenceCardinality estimates the number of unique inputs that were added to a but not to b,
+// using the inclusion-exclusion principle: |A\B| = |A∪B| - |B|. Neither input is modified. A
+// *PrecisionMismatchError is returned if a and b have different p or pPrime, and a
+// *HashMismatchError if they record different hash functions.
+func DifferenceCardinality(a, b *Hll) (uint64, error) {
+	union, err := Union(a, b)
+	if err != nil {
+		return 0, err
+	}
+	cardA, cardB := a.readOnlyCardinality(), b.readOnlyCardinality()
+	cardUnion := union.Cardinality()
+
+	if cardUnion <= cardB {
+		return 0, nil
+	}
+	return minU64(cardUnion-cardB, cardA), nil
+}
+
+// Similarity holds estimates of how much two sets A and B overlap.
+type Similarity struct {
+	Jaccard     float64 // |A∩B| / |A∪B|, or 0 if both sets are empty.
+	Containment float64 // |A∩B| / |A|, or 0 if A is empty.
+
+	// The estimator used for |A∪B|. The sizes of A and B are estimated from the same kind of
+	// registers, so they use RegimeSparse exactly when the union does.
+	Regime Regime
+}
+
+// EstimateSimilarity estimates the Jaccard similarity and the containment of the sets A and B whose
+// sketches are a and b. The sizes of A, B and A∪B are estimated in a single pass over the registers
+// of both sketches, and the size of A∩B is derived from them using the inclusion-exclusion
+// principle. Neither input is modified. A *PrecisionMismatchError is returned if a and b have
+// different p or pPrime, and a *HashMismatchError if they record different hash functions.
+//
+// If both sketches are sparse the sparse lists are walked together and linear counting is used, as
+// Cardinality would. Otherwise the dense registers are used.
+func EstimateSimilarity(a, b *Hll) (Similarity, error) {
+	if err := a.checkCombinable(b); err != nil {
+		return Similarity{}, err
+	}
+
+	var cardA, cardB, cardUnion uint64
+	var regime Regime
+	if a.isSparse && b.isSparse {
+		numA, numB, numUnion := countSparseUnion(a, b)
+		cardA = linearCounting(a.mPrime, a.mPrime-numA)
+		cardB = linearCounting(a.mPrime, a.mPrime-numB)
+		cardUnion = linearCounting(a.mPrime, a.mPrime-numUnion)
+		regime = RegimeSparse
+	} else {
+		regsA, regsB := a.readOnlyRegisters(), b.readOnlyRegisters()
+		var sumA, sumB, sumUnion float64
+		var zerosA, zerosB, zerosUnion uint64
+		for i := uint64(0); i < a.m; i++ {
+			valA, valB := regsA.Get(i), regsB.Get(i)
+			valUnion := maxU8(valA, valB)
+			sumA += 1 / lookupTable[valA]
+			sumB += 1 / lookupTable[valB]
+			sumUnion += 1 / lookupTable[valUnion]
+			if valA == 0 {
+				zerosA++
+			}
+			if valB == 0 {
+				zerosB++
+			}
+			if valUnion == 0 {
+				zerosUnion++
+			}
+		}
+		cardA, _ = a.estimateFromRegisterSums(sumA, zerosA)
+		cardB, _ = a.estimateFromRegisterSums(sumB, zerosB)
+		cardUnion, regime = a.estimateFromRegisterSums(sumUnion, zerosUnion)
+	}
+
+	sim := Similarity{Regime: regime}
+	if cardA+cardB <= cardUnion {
+		return sim, nil
+	}
+	intersection := float64(minU64(cardA+cardB-cardUnion, minU64(cardA, cardB)))
+	sim.Jaccard = intersection / float64(cardUnion)
+	sim.Containment = intersection / float64(cardA)
+	return sim, nil
+}
+
+// Walks the sparse lists of a and b together, and returns the number of indexes in each and in
+// their union.
+func countSparseUnion(a, b *Hll) (numA, numB, numUnion uint64) {
+	leftIt := makeMergeElemIter(a.p, a.pPrime, a.readOnlySparse().GetIterator())
+	rightIt := makeMergeElemIter(b.p, b.pPrime, b.readOnlySparse().GetIterator())
+
+	left, haveLeft := leftIt()
+	right, haveRight := rightIt()
+	for haveLeft || haveRight {
+		numUnion++
+		switch {
+		case !haveRight || (haveLeft && left.index < right.index):
+			numA++
+			left, haveLeft = leftIt()
+		case !haveLeft || right.index < left.index:
+			numB++
+			right, haveRight = rightIt()
+		default:
+			numA++
+			numB++
+			left, haveLeft = leftIt()
+			right, haveRight = rightIt()
+		}
+	}
+	return numA, numB, numUnion
+}
+
+// JointEstimate holds estimates of the sizes of the three disjoint parts of the union of two sets
+// A and B, along with their standard errors. A standard error is NaN if it couldn't be computed,
+// which happens when its estimate is less than one.
+type JointEstimate struct {
+	OnlyA        float64 // |A\B|
+	OnlyB        float64 // |B\A|
+	Intersection float64 // |A∩B|
+
+	OnlyAStdErr, OnlyBStdErr, IntersectionStdErr float64
+}
+
+// EstimateJoint estimates the sizes of A\B, B\A and A∩B from the registers of the sketches a and b
+// of the sets A and B, using the joint maximum likelihood method from "New cardinality estimation
+// methods for HyperLogLog sketches" by Otmar Ertl. This is considerably more accurate than the
+// inclusion-exclusion principle used by IntersectionCardinality and DifferenceCardinality. Neither
+// input is modified. A *PrecisionMismatchError is returned if a and b have different p or pPrime,
+// and a *HashMismatchError if they record different hash functions.
+//
+// The registers of sparse sketches are rebuilt at precision p, so small sets get the accuracy of
+// the dense representation rather than that of the sparse one. The model assumes that the register
+// values don't depend on the register index, which doesn't hold for the registers that a dense
+// sketch got from its sparse list when it switched to the dense representation. The estimates are
+// most accurate when both sketches are sparse, or when their cardinalities are large compared to
+// 2^p so that the registers set since the switch dominate.
+func EstimateJoint(a, b *Hll) (JointEstimate, error) {
+	if err := a.checkCombinable(b); err != nil {
+		return JointEstimate{}, err
+	}
+
+	// Every register pair contributes to the likelihood according to its two values, so only the
+	// number of registers with each pair of values is needed.
+	model := newJointModel(a.p)
+	regsA, regsB := jointRegisters(a, b)
+	for i := uint64(0); i < a.m; i++ {
+		model.counts[model.clamp(regsA.Get(i))][model.clamp(regsB.Get(i))]++
+	}
+
+	// Start from the inclusion-exclusion estimates. The optimization works on the logarithms of
+	// the rates so that they stay positive.
+	cardA, cardB := float64(a.readOnlyCardinality()), float64(b.readOnlyCardinality())
+	union, _ := Union(a, b)
+	cardUnion := float64(union.Cardinality())
+	start := [3]float64{
+		math.Log(math.Max(cardUnion-cardB, 1)),
+		math.Log(math.Max(cardUnion-cardA, 1)),
+		math.Log(math.Max(cardA+cardB-cardUnion, 1)),
+	}
+	theta := maximize(model.logLikelihood, start)
+
+	est := JointEstimate{
+		OnlyA:        math.Exp(theta[0]),
+		OnlyB:        math.Exp(theta[1]),
+		Intersection: math.Exp(theta[2]),
+	}
+
+	// The covariance of the maximum likelihood estimates is the inverse of the observed
+	// information, which is the negated Hessian of the log-likelihood at the maximum. The delta
+	// method turns the variance of log(λ) into the variance of λ. Estimates of less than one input
+	// are at the boundary of the parameter space, where the log-likelihood is flat, so they're left
+	// out.
+	hess := hessian(model.logLikelihood, theta)
+	var active []int
+	for i := range theta {
+		if theta[i] >= 0 {
+			active = append(active, i)
+		}
+	}
+	info := make([][]float64, len(active))
+	for row, i := range active {
+		info[row] = make([]float64, len(active))
+		for col, k := range active {
+			info[row][col] = -hess[i][k]
+		}
+	}
+
+	stdErrs := [3]float64{math.NaN(), math.NaN(), math.NaN()}
+	if cov, ok := invert(info); ok {
+		for row, i := range active {
+			if cov[row][row] >= 0 {
+				stdErrs[i] = math.Exp(theta[i]) * math.Sqrt(cov[row][row])
+			}
+		}
+	}
+	est.OnlyAStdErr, est.OnlyBStdErr, est.IntersectionStdErr = stdErrs[0], stdErrs[1], stdErrs[2]
+	return est, nil
+}
+
+// Returns the cardinality estimate of h without modifying h.
+func (h *Hll) readOnlyCardinality() uint64 {
+	if len(h.tempSet) == 0 {
+		return h.Cardinality() // This doesn't modify h when the temp set is empty.
+	}
+	return h.Copy().Cardinality()
+}
+
+// Returns the dense registers of a and b for joint estimation, without modifying either. A result is
+// the bigM of its sketch when that sketch is dense, so it must not be modified.
+//
+// When both sketches are sparse, their registers aren't built with toNormal. getIndex takes the
+// index from the low-order bits of the pPrime-bit prefix of the hash, which overlap the bits that
+// rho is taken from, so the registers built by toNormal have rho values that depend on their index.
+// That doesn't matter to linear counting, but it breaks the joint model. The index is taken from
+// the leading p bits of the prefix instead. When either sketch is dense the registers are built the
+// way Combine builds them, so that both sketches put their inputs in the same registers.
+func jointRegisters(a, b *Hll) (registers, registers) {
+	if !a.isSparse || !b.isSparse {
+		return a.readOnlyRegisters(), b.readOnlyRegisters()
+	}
+	return a.sparseRegisters(), b.sparseRegisters()
+}
+
+// Returns the dense registers of h the way Combine would build them, without modifying h.
+func (h *Hll) readOnlyRegisters() registers {
+	if !h.isSparse {
+		return h.bigM
+	}
+	return toNormal(h.readOnlySparse(), h.p, h.pPrime)
+}
+
+// Returns the registers of the sparse sketch h, indexed by the leading p bits of each hash.
+func (h *Hll) sparseRegisters() normal {
+	regs := newNormal(h.m)
+	it := h.readOnlySparse().GetIterator()
+	for {
+		k, ok := it()
+		if !ok {
+			break
+		}
+		var idx uint64
+		var r uint8
+		if k&1 == 1 {
+			idx = k >> (7 + h.pPrime - h.p)
+			// As in decodeHash, a register can't hold more than 63.
+			r = uint8(minU64(extractShift(k, 1, 6)+uint64(h.pPrime-h.p), 63))
+		} else {
+			idx = k >> (1 + h.pPrime - h.p)
+			r = rho(extractShift(k, 1, h.pPrime-h.p))
+		}
+		regs.Set(idx, maxU8(regs.Get(idx), r))
+	}
+	return regs
+}
+
+// Returns the registers of h for exporting to another library's sketch, without modifying h. For
+// a dense sketch this is its bigM, which must not be modified.
+//
+// A sparse sketch's registers are those that a dense sketch given the same hashes would have, as
+// far as the sparse list keeps them. Each hash is placed by the leading p bits of its sparse index,
+// like addNormal places it. A flagged encoded hash keeps the rho of the low-order bits, which is the
+// rho of the whole hash unless those bits are all zero. Any other encoded hash doesn't keep the
+// low-order bits, so its register gets 1, the least rho it could have. The registers are never
+// larger than the dense sketch's, so merging them into another library's sketch of the same values
+// leaves that sketch unchanged.
+func (h *Hll) exportRegisters() registers {
+	if !h.isSparse {
+		return h.bigM
+	}
+	regs := newNormal(h.m)
+	it := h.readOnlySparse().GetIterator()
+	for k, ok := it(); ok; k, ok = it() {
+		var idx uint64
+		r := uint8(1)
+		if k&1 == 1 {
+			idx = k >> (7 + h.pPrime - h.p)
+			r = uint8(extractShift(k, 1, 6))
+			if r == rho(0) {
+				// The low-order bits are zero, and so are the bits after the dense index.
+				r = rho(k >> 7 << (64 - h.pPrime))
+			}
+		} else {
+			idx = k >> (1 + h.pPrime - h.p)
+		}
+		regs.Set(idx, maxU8(regs.Get(idx), r))
+	}
+	return regs
+}
+
+// The Poisson model of a pair of HyperLogLog sketches. The inputs that are only in A, only in B,
+// and in both arrive at each register as Poisson processes with rates λa/m, λb/m and λx/m, and each
+// input sets its register to at least k with probability 2^-(k-1). A register can't exceed q+1.
+type jointModel struct {
+	m      float64
+	q      int
+	counts [][]float64 // counts[i][j] is the number of registers with value i in A and j in B.
+}
+
+func newJointModel(p uint) *jointModel {
+	q := 64 - int(p)
+	counts := make([][]float64, q+2)
+	for i := range counts {
+		counts[i] = make([]float64, q+2)
+	}
+	return &jointModel{float64(uint64(1) << p), q, counts}
+}
+
+func (j *jointModel) clamp(r uint8) int {
+	if int(r) > j.q+1 {
+		return j.q + 1
+	}
+	return int(r)
+}
+
+// Returns the probability that no input with a per-register rate of λ/m (passed as rate) set a
+// register higher than k.
+func (j *jointModel) cdf(rate float64, k int) float64 {
+	if k < 0 {
+		return 0
+	}
+	if k > j.q {
+		return 1
+	}
+	return math.Exp(-rate * math.Ldexp(1, -k))
+}
+
+// Returns the probability that the maximum of the inputs with a per-register rate of λ/m (passed
+// as rate) set a register to exactly k.
+func (j *jointModel) pmf(rate float64, k int) float64 {
+	switch {
+	case k == 0:
+		return math.Exp(-rate)
+	case k > j.q:
+		return -math.Expm1(-rate * math.Ldexp(1, -j.q))
+	default:
+		// exp(-rate*2^-k) - exp(-rate*2^-(k-1)), computed without cancellation.
+		return math.Exp(-rate*math.Ldexp(1, -k)) * -math.Expm1(-rate*math.Ldexp(1, -k))
+	}
+}
+
+// Returns the log-likelihood of the observed register counts, given the logarithms of λa, λb and
+// λx.
+func (j *jointModel) logLikelihood(theta [3]float64) float64 {
+	a, b, x := math.Exp(theta[0])/j.m, math.Exp(theta[1])/j.m, math.Exp(theta[2])/j.m
+
+	var sum float64
+	for ka, row := range j.counts {
+		for kb, count := range row {
+			if count == 0 {
+				continue
+			}
+			var prob float64
+			switch {
+			case ka < kb:
+				// The register of B was set by an input that's only in B.
+				prob = j.pmf(a+x, ka) * j.pmf(b, kb)
+			case ka > kb:
+				prob = j.pmf(b+x, kb) * j.pmf(a, ka)
+			default:
+				// Either a shared input set both registers, or an input that's only in A and
+				// another that's only in B happened to set them to the same value.
+				prob = j.pmf(x, ka)*j.cdf(a, ka)*j.cdf(b, ka) +
+					j.cdf(x, ka-1)*j.pmf(a, ka)*j.pmf(b, ka)
+			}
+			if prob <= 0 {
+				return math.Inf(-1)
+			}
+			sum += count * math.Log(prob)
+		}
+	}
+	return sum
+}
+
+// Maximizes f using the Nelder-Mead method, starting from start.
+func maximize(f func([3]float64) float64, start [3]float64) [3]float64 {
+	const (
+		maxIterations = 2000
+		tolerance     = 1e-10
+		initialStep   = 0.5
+	)
+
+	var simplex [4][3]float64
+	var values [4]float64
+	for i := range simplex {
+		simplex[i] = start
+		if i > 0 {
+			simplex[i][i-1] += initialStep
+		}
+		values[i] = f(simplex[i])
+	}
+
+	for iter := 0; iter < maxIterations; iter++ {
+		// Order the vertices from best (highest) to worst.
+		for i := 1; i < 4; i++ {
+			for k := i; k > 0 && values[k] > values[k-1]; k-- {
+				simplex[k], simplex[k-1] = simplex[k-1], simplex[k]
+				values[k], values[k-1] = values[k-1], values[k]
+			}
+		}
+		if math.Abs(values[0]-values[3]) <= tolerance*(math.Abs(values[0])+tolerance) {
+			break
+		}
+
+		var centroid [3]float64
+		for i := 0; i < 3; i++ {
+			for d := range centroid {
+				centroid[d] += simplex[i][d] / 3
+			}
+		}
+		along := func(t float64) [3]float64 {
+			var point [3]float64
+			for d := range point {
+				point[d] = centroid[d] + t*(simplex[3][d]-centroid[d])
+			}
+			return point
+		}
+
+		reflected := along(-1)
+		reflectedValue := f(reflected)
+		switch {
+		case reflectedValue > values[0]:
+			expanded := along(-2)
+			if expandedValue := f(expanded); expandedValue > reflectedValue {
+				simplex[3], values[3] = expanded, expandedValue
+			} else {
+				simplex[3], values[3] = reflected, reflectedValue
+			}
+		case reflectedValue > values[2]:
+			simplex[3], values[3] = reflected, reflectedValue
+		default:
+			contracted := along(0.5)
+			if contractedValue := f(contracted); contractedValue > values[3] {
+				simplex[3], values[3] = contracted, contractedValue
+			} else {
+				// Shrink everything towards the best vertex.
+				for i := 1; i < 4; i++ {
+					for d := range simplex[i] {
+						simplex[i][d] = simplex[0][d] + 0.5*(simplex[i][d]-simplex[0][d])
+					}
+					values[i] = f(simplex[i])
+				}
+			}
+		}
+	}
+
+	best := 0
+	for i := range values {
+		if values[i] > values[best] {
+			best = i
+		}
+	}
+	return simplex[best]
+}
+
+// Returns the Hessian of f at x, using central differences.
+func hessian(f func([3]float64) float64, x [3]float64) [3][3]float64 {
+	const step = 1e-4
+
+	at := func(i int, di float64, k int, dk float64) float64 {
+		point := x
+		point[i] += di
+		point[k] += dk
+		return f(point)
+	}
+
+	var hess [3][3]float64
+	for i := 0; i < 3; i++ {
+		for k := i; k < 3; k++ {
+			hess[i][k] = (at(i, step, k, step) - at(i, step, k, -step) - at(i, -step, k, step) +
+				at(i, -step, k, -step)) / (4 * step * step)
+			hess[k][i] = hess[i][k]
+		}
+	}
+	return hess
+}
+
+// Inverts a square matrix using Gauss-Jordan elimination. The second result is false if the matrix
+// is singular.
+func invert(a [][]float64) ([][]float64, bool) {
+	n := len(a)
+	work := make([][]float64, n)
+	inv := make([][]float64, n)
+	for i := range a {
+		work[i] = append([]float64{}, a[i]...)
+		inv[i] = make([]float64, n)
+		inv[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(work[row][col]) > math.Abs(work[pivot][col]) {
+				pivot = row
+			}
+		}
+		if work[pivot][col] == 0 || math.IsNaN(work[pivot][col]) {
+			return nil, false
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		scale := work[col][col]
+		for k := 0; k < n; k++ {
+			work[col][k] /= scale
+			inv[col][k] /= scale
+		}
+		for row := 0; row < n; row++ {
+			if row == col {
+				continue
+			}
+			factor := work[row][col]
+			for k := 0; k < n; k++ {
+				work[row][k] -= factor * work[col][k]
+				inv[row][k] -= factor * inv[col][k]
+			}
+		}
+	}
+	return inv, true
+}
+
+func minU64(x, y uint64) uint64 {
+	if x <= y {
+		return x
+	}
+	return y
+}
@@ -0,0 +1,229 @@
+package hll
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// Returns sketches of two sets that have onlyA, onlyB and both elements in the obvious places. If
+// dense is set, the sketches skip the sparse representation.
+func overlappingSketches(t *testing.T, p, pPrime uint, onlyA, onlyB, both int,
+	dense bool) (a, b *Hll) {
+
+	a, b = NewHll(p, pPrime), NewHll(p, pPrime)
+	if dense {
+		a.switchToNormal()
+		b.switchToNormal()
+	}
+	for _, x := range randUint64s(t, onlyA) {
+		a.Add(x)
+	}
+	for _, x := range randUint64s(t, onlyB) {
+		b.Add(x)
+	}
+	for _, x := range randUint64s(t, both) {
+		a.Add(x)
+		b.Add(x)
+	}
+	return a, b
+}
+
+func TestIntersectionAndDifference(t *testing.T) {
+	testCases := []struct {
+		onlyA, onlyB, both int
+	}{
+		{100000, 100000, 100000},
+		{20000, 50000, 30000},
+		{0, 0, 50000},
+		{50000, 50000, 0},
+	}
+
+	for i, testCase := range testCases {
+		a, b := overlappingSketches(t, 14, 25, testCase.onlyA, testCase.onlyB, testCase.both,
+			false)
+		unionCard := float64(testCase.onlyA + testCase.onlyB + testCase.both)
+
+		// The error of inclusion-exclusion is relative to the union.
+		intersection, err := IntersectionCardinality(a, b)
+		assert.Equal(t, nil, err)
+		if math.Abs(float64(intersection)-float64(testCase.both)) > 0.05*unionCard {
+			t.Errorf("Testcase %d: intersection %d, expected %d", i, intersection, testCase.both)
+		}
+
+		difference, err := DifferenceCardinality(a, b)
+		assert.Equal(t, nil, err)
+		if math.Abs(float64(difference)-float64(testCase.onlyA)) > 0.05*unionCard {
+			t.Errorf("Testcase %d: difference %d, expected %d", i, difference, testCase.onlyA)
+		}
+	}
+
+	_, err := IntersectionCardinality(NewHll(14, 25), NewHll(12, 25))
+	assert.T(t, errors.Is(err, ErrPrecisionMismatch))
+	_, err = DifferenceCardinality(NewHll(14, 25), NewHll(12, 25))
+	assert.T(t, errors.Is(err, ErrPrecisionMismatch))
+}
+
+func TestEstimateJoint(t *testing.T) {
+	testCases := []struct {
+		p                  uint
+		onlyA, onlyB, both int
+		dense              bool
+	}{
+		{12, 100000, 100000, 100000, false},
+		{12, 20000, 50000, 5000, false},
+		{10, 0, 50000, 50000, false},
+		{14, 1000, 300, 2000, true},
+		{12, 100, 40, 30, false}, // Both sketches are sparse.
+	}
+
+	for i, testCase := range testCases {
+		a, b := overlappingSketches(t, testCase.p, 25, testCase.onlyA, testCase.onlyB,
+			testCase.both, testCase.dense)
+		aTempSet := len(a.tempSet)
+
+		est, err := EstimateJoint(a, b)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, len(a.tempSet), aTempSet)
+
+		check := func(name string, actual, stdErr float64, expected int) {
+			if expected == 0 && actual < 1 {
+				return // The standard error of an empty set can't be computed.
+			}
+			if math.IsNaN(stdErr) || stdErr < 0 {
+				t.Errorf("Testcase %d: %s standard error %v", i, name, stdErr)
+			}
+			// Allow five standard errors, plus a little slack for the sets that are empty.
+			if math.Abs(actual-float64(expected)) > 5*stdErr+10 {
+				t.Errorf("Testcase %d: %s estimate %v±%v, expected %d", i, name, actual, stdErr,
+					expected)
+			}
+		}
+		check("onlyA", est.OnlyA, est.OnlyAStdErr, testCase.onlyA)
+		check("onlyB", est.OnlyB, est.OnlyBStdErr, testCase.onlyB)
+		check("intersection", est.Intersection, est.IntersectionStdErr, testCase.both)
+
+		// The standard error should be in the same ballpark as the HyperLogLog error of the union.
+		unionCard := float64(testCase.onlyA + testCase.onlyB + testCase.both)
+		assert.Tf(t, est.IntersectionStdErr < 3*1.04/math.Sqrt(float64(a.m))*unionCard+10,
+			"Testcase %d: standard error %v is too large", i, est.IntersectionStdErr)
+	}
+
+	_, err := EstimateJoint(NewHll(14, 25), NewHll(14, 20))
+	assert.T(t, errors.Is(err, ErrPrecisionMismatch))
+}
+
+func TestInvert(t *testing.T) {
+	a := [][]float64{{4, 7, 2}, {3, 6, 1}, {2, 5, 3}}
+	inv, ok := invert(a)
+	assert.T(t, ok)
+	for i := 0; i < 3; i++ {
+		for k := 0; k < 3; k++ {
+			var product float64
+			for j := 0; j < 3; j++ {
+				product += a[i][j] * inv[j][k]
+			}
+			expected := 0.0
+			if i == k {
+				expected = 1
+			}
+			assert.Tf(t, math.Abs(product-expected) < 1e-12, "%d,%d: %v", i, k, product)
+		}
+	}
+
+	_, ok = invert([][]float64{{1, 2, 3}, {2, 4, 6}, {1, 1, 1}})
+	assert.T(t, !ok)
+}
+
+func TestEstimateSimilarity(t *testing.T) {
+	testCases := []struct {
+		onlyA, onlyB, both int
+		regime             Regime
+	}{
+		{100000, 100000, 100000, RegimeRaw},
+		{5000, 5000, 5000, RegimeBiasCorrected},
+		{1000, 500, 1000, RegimeLinearCounting},
+		{100, 50, 150, RegimeSparse},
+		{0, 0, 200, RegimeSparse},
+		{200, 200, 0, RegimeSparse},
+	}
+
+	for i, testCase := range testCases {
+		a, b := overlappingSketches(t, 12, 25, testCase.onlyA, testCase.onlyB, testCase.both,
+			false)
+		aTempSet := len(a.tempSet)
+
+		sim, err := EstimateSimilarity(a, b)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, len(a.tempSet), aTempSet)
+		assert.Equalf(t, sim.Regime, testCase.regime, "Testcase %d: regime %v", i, sim.Regime)
+
+		union := float64(testCase.onlyA + testCase.onlyB + testCase.both)
+		jaccard := float64(testCase.both) / union
+		containment := float64(testCase.both) / float64(testCase.onlyA+testCase.both)
+		if math.Abs(sim.Jaccard-jaccard) > 0.1 {
+			t.Errorf("Testcase %d: Jaccard %v, expected %v", i, sim.Jaccard, jaccard)
+		}
+		if math.Abs(sim.Containment-containment) > 0.1 {
+			t.Errorf("Testcase %d: containment %v, expected %v", i, sim.Containment, containment)
+		}
+
+		// The union estimate should be the one that Union would give.
+		u, _ := Union(a, b)
+		card, regime := u.Cardinality(), RegimeSparse
+		if !u.isSparse {
+			card, regime = u.estimateNormal()
+		}
+		assert.Equalf(t, sim.Regime, regime, "Testcase %d", i)
+		if sim.Jaccard > 0 {
+			inter, _ := IntersectionCardinality(a, b)
+			assert.Tf(t, math.Abs(sim.Jaccard-float64(inter)/float64(card)) < 1e-9,
+				"Testcase %d: %v != %d/%d", i, sim.Jaccard, inter, card)
+		}
+	}
+
+	sim, err := EstimateSimilarity(NewHll(12, 25), NewHll(12, 25))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, sim, Similarity{0, 0, RegimeSparse})
+
+	_, err = EstimateSimilarity(NewHll(14, 25), NewHll(14, 20))
+	assert.T(t, errors.Is(err, ErrPrecisionMismatch))
+}
+
+func TestSparseRegistersMaxRho(t *testing.T) {
+	// A hash whose low-order bits are all zero has a rho of 63 in the sparse list, which can't be
+	// extended by pPrime-p bits in a 6-bit register.
+	h := NewHll(10, 25)
+	h.Add(0)
+	regs := h.sparseRegisters()
+	assert.Equal(t, regs.Get(0), uint8(63))
+	assert.Equal(t, regs.Get(1), uint8(0))
+}
+
+func TestExportRegisters(t *testing.T) {
+	// With p=10 and pPrime=15, the sparse index is the top 15 bits and the low-order bits are the
+	// other 49. These hashes all have different getIndex values, so the sparse list keeps them all.
+	hashes := []uint64{
+		3<<54 | 1<<20,        // The low-order bits have the rho of the hash.
+		5 << 54,              // The low-order bits are zero.
+		7<<54 | 1<<50 | 1<<3, // The low-order bits aren't kept.
+		9<<54 | 1<<50,        // Nor here, but the next hash in the register has a larger rho.
+		9<<54 | 1<<38,
+	}
+	h, dense := NewHll(10, 15), NewHll(10, 15)
+	dense.switchToNormal()
+	for _, x := range hashes {
+		h.Add(x)
+		dense.Add(x)
+	}
+	assert.T(t, h.isSparse)
+	assert.Equal(t, h.readOnlySparse().GetNumElements(), uint64(len(hashes)))
+	expected := map[uint64]uint8{3: 21, 5: 55, 7: 1, 9: 39}
+	regs := h.exportRegisters()
+	for i := uint64(0); i < h.m; i++ {
+		assert.Equalf(t, regs.Get(i), expected[i], "register %d", i)
+		assert.T(t, regs.Get(i) <= dense.bigM.Get(i))
+	}
+}
@@ -0,0 +1,188 @@
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrInvalidShards is returned when the number of shards of a ShardedHll isn't a power of two
+// between 1 and 2^p.
+var ErrInvalidShards = errors.New("hll: shards must be a power of two between 1 and 2^p")
+
+// ShardedHll is a sketch for concurrent, high-throughput ingestion. It's made of several shards,
+// each an Hll with its own mutex, so goroutines adding at the same time rarely wait for each other.
+//
+// An input is sent to the shard given by the leading bits of its hash, which are also the leading
+// bits of the register that a dense sketch puts it in. The shards see disjoint sets of registers,
+// so inputs added to dense shards set exactly the registers that they would in a single dense Hll.
+// Inputs that a shard holds in its sparse list are only placed in registers when it switches to the
+// dense representation, and each shard switches at its own time, so until every shard is dense the
+// union's registers and estimate may differ slightly from those of a single Hll given the same
+// inputs. Each shard may take as much memory as a single Hll.
+//
+// A custom Hasher (see WithHasher) must be safe for concurrent use, since inputs are hashed outside
+// of the shard mutexes.
+type ShardedHll struct {
+	shards    []shard
+	shardBits uint
+	template  *Hll // An empty sketch configured like a single sketch, for Snapshot.
+	hasher    Hasher
+	hashID    HashID
+}
+
+type shard struct {
+	mu sync.Mutex
+	h  *Hll
+	_  [64]byte // Keeps the mutexes of neighboring shards out of the same cache line.
+}
+
+// NewSharded returns a ShardedHll with the given number of shards, which must be a power of two
+// between 1 and 2^p. The shards are configured by opts, as in New, except that the sparse threshold
+// and merge size are divided between the shards. That way the shards switch to the dense
+// representation after about as many inputs as a single sketch would.
+//
+// Each dense shard has all 2^p registers, so a dense ShardedHll takes numShards times the memory of
+// a single dense Hll. With the default 6-bit registers that is 12 KB per shard at p=14, or about
+// 200 MB with 2^14 shards. A few shards per core is usually enough to avoid contention.
+func NewSharded(numShards int, opts ...Option) (*ShardedHll, error) {
+	template, err := New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if numShards < 1 || numShards&(numShards-1) != 0 || uint64(numShards) > template.m {
+		return nil, fmt.Errorf("%w: got %d shards with p=%d", ErrInvalidShards, numShards,
+			template.p)
+	}
+
+	shardOpts := append(opts[:len(opts):len(opts)],
+		WithSparseThresholdBits(maxU64(template.sparseThresholdBits/uint64(numShards), 1)),
+		WithMergeSizeBits(maxU64(template.mergeSizeBits/uint64(numShards), 1)))
+	s := &ShardedHll{
+		shards:   make([]shard, numShards),
+		template: template,
+	}
+	for i := range s.shards {
+		if s.shards[i].h, err = New(shardOpts...); err != nil {
+			return nil, err
+		}
+	}
+	for numShards > 1 {
+		s.shardBits++
+		numShards >>= 1
+	}
+
+	// The shards already record the hash ID of a hasher set by the options. As for an Hll, the ID
+	// of the default hasher is only recorded by a shard once it's given a hash from AddBytes. A
+	// sketch that's only given hashes may record a hash ID that isn't registered, in which case
+	// there's no hasher, and AddBytes panics.
+	s.hasher, s.hashID = template.hasher, template.hashID
+	if s.hasher == nil {
+		if s.hashID.IsZero() {
+			s.hasher = XXHash64{}
+		} else {
+			s.hasher = lookupHasher(s.hashID)
+		}
+	}
+	if s.hashID.IsZero() {
+		s.hashID = hasherID(s.hasher)
+	}
+	return s, nil
+}
+
+// Returns the shard for the hash x. A shift by 64 gives 0, so there's one shard when shardBits is 0.
+func (s *ShardedHll) shardFor(x uint64) *shard {
+	return &s.shards[x>>(64-s.shardBits)]
+}
+
+// Add is like Hll.Add.
+func (s *ShardedHll) Add(x uint64) {
+	sh := s.shardFor(x)
+	sh.mu.Lock()
+	sh.h.Add(x)
+	sh.mu.Unlock()
+}
+
+// AddMany is like Hll.AddMany. The batch is split up by shard, and each shard is locked once.
+func (s *ShardedHll) AddMany(xs []uint64) {
+	if len(s.shards) == 1 {
+		s.addManyToShard(&s.shards[0], xs)
+		return
+	}
+	batches := make([][]uint64, len(s.shards))
+	for _, x := range xs {
+		i := x >> (64 - s.shardBits)
+		batches[i] = append(batches[i], x)
+	}
+	for i, batch := range batches {
+		if len(batch) > 0 {
+			s.addManyToShard(&s.shards[i], batch)
+		}
+	}
+}
+
+func (s *ShardedHll) addManyToShard(sh *shard, xs []uint64) {
+	sh.mu.Lock()
+	sh.h.AddMany(xs)
+	sh.mu.Unlock()
+}
+
+// AddBytes is like Hll.AddBytes. It panics if the sketch records a HashID that isn't registered
+// (see RegisterHasher) and no Hasher was given with WithHasher.
+func (s *ShardedHll) AddBytes(b []byte) {
+	if s.hasher == nil {
+		panic(fmt.Sprintf("hll: no hasher is registered for %v", s.hashID))
+	}
+	x := s.hasher.Sum64(b)
+	sh := s.shardFor(x)
+	sh.mu.Lock()
+	if sh.h.hashID.IsZero() {
+		sh.h.hashID = s.hashID
+	}
+	sh.h.Add(x)
+	sh.mu.Unlock()
+}
+
+// AddString is like Hll.AddString.
+func (s *ShardedHll) AddString(str string) {
+	s.AddBytes([]byte(str))
+}
+
+// AddUint64Value is like Hll.AddUint64Value.
+func (s *ShardedHll) AddUint64Value(v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	s.AddBytes(buf[:])
+}
+
+// Snapshot returns an Hll that's the union of all of the shards. It's owned by the caller, and has
+// the sparse threshold and merge size of a single sketch. Each shard is only locked while it's
+// copied, so adding can continue while the copies are merged.
+func (s *ShardedHll) Snapshot() *Hll {
+	union := s.template.Copy()
+	copies := make([]*Hll, len(s.shards))
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		copies[i] = sh.h.Copy()
+		sh.mu.Unlock()
+		// The shards are only given hashes from the same hasher, so any of them that knows its hash
+		// function knows the union's.
+		if union.hashID.IsZero() {
+			union.hashID = copies[i].hashID
+		}
+	}
+	union.mergeAll(copies)
+	return union
+}
+
+// Cardinality returns the estimated cardinality of the union of the shards.
+func (s *ShardedHll) Cardinality() uint64 {
+	return s.Snapshot().Cardinality()
+}
+
+// Estimate is like Hll.Estimate, for the union of the shards.
+func (s *ShardedHll) Estimate() Estimate {
+	return s.Snapshot().Estimate()
+}
@@ -0,0 +1,131 @@
+package hll
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// In the dense representation, the union of the shards has exactly the registers of a single
+// sketch given the same inputs.
+func TestShardedHllDense(t *testing.T) {
+	s, err := NewSharded(16, WithP(12))
+	assert.Equal(t, nil, err)
+	for i := range s.shards {
+		s.shards[i].h.switchToNormal()
+	}
+	single := NewHll(12, 25)
+	single.switchToNormal()
+
+	for _, x := range randUint64s(t, 100000) {
+		s.Add(x)
+		single.Add(x)
+	}
+	snapshot := s.Snapshot()
+	assert.Equal(t, snapshot.bigM, single.bigM)
+	assert.Equal(t, snapshot.Cardinality(), single.Cardinality())
+}
+
+func TestShardedHllConcurrent(t *testing.T) {
+	const goroutines, perGoroutine = 8, 20000
+
+	s, err := NewSharded(8)
+	assert.Equal(t, nil, err)
+	single := NewHll(14, 25)
+
+	inputs := make([][]uint64, goroutines)
+	for i := range inputs {
+		inputs[i] = randUint64s(t, perGoroutine)
+		for _, x := range inputs[i] {
+			single.Add(x)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(inputs []uint64) {
+			defer wg.Done()
+			for j, x := range inputs {
+				s.Add(x)
+				if j%5000 == 0 {
+					s.Cardinality()
+				}
+			}
+		}(inputs[i])
+	}
+	wg.Wait()
+
+	// The shards switch from the sparse to the dense representation at different times than the
+	// single sketch, so the estimates are close but not always equal.
+	card, expected := float64(s.Cardinality()), float64(single.Cardinality())
+	assert.Tf(t, math.Abs(card-expected) < 0.01*expected, "%v != %v", card, expected)
+}
+
+func TestShardedHllHashing(t *testing.T) {
+	s, err := NewSharded(4, WithP(12))
+	assert.Equal(t, nil, err)
+	single := NewHll(12, 25)
+	for i := 0; i < 100; i++ {
+		s.AddUint64Value(uint64(i))
+		s.AddString("a")
+		single.AddUint64Value(uint64(i))
+		single.AddString("a")
+	}
+	snapshot := s.Snapshot()
+	assert.Equal(t, snapshot.HashID(), single.HashID())
+	assert.Equal(t, snapshot.Cardinality(), single.Cardinality())
+
+	// Without hashing, the hash function is unknown.
+	s, err = NewSharded(4)
+	assert.Equal(t, nil, err)
+	s.Add(randUint64(t))
+	assert.T(t, s.Snapshot().HashID().IsZero())
+
+	s, err = NewSharded(4, WithHasher(XXHash64{3}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Snapshot().HashID(), HashID{XXHash64Name, 3})
+
+	// Hashes computed outside of the sketch can be recorded with a hash ID that isn't registered.
+	// Only hashing in the sketch needs a registered hasher.
+	id := HashID{"external", 1}
+	s, err = NewSharded(4, WithHashID(id))
+	assert.Equal(t, nil, err)
+	s.Add(randUint64(t))
+	assert.Equal(t, s.Snapshot().HashID(), id)
+	defer func() {
+		assert.NotEqual(t, recover(), nil)
+	}()
+	s.AddString("a")
+}
+
+func TestNewShardedErrors(t *testing.T) {
+	for _, numShards := range []int{0, -1, 3, 1 << 13} {
+		_, err := NewSharded(numShards, WithP(12))
+		assert.Tf(t, errors.Is(err, ErrInvalidShards), "%d shards: %v", numShards, err)
+	}
+	_, err := NewSharded(1<<12, WithP(12))
+	assert.Equal(t, nil, err)
+	_, err = NewSharded(4, WithP(2))
+	assert.T(t, errors.Is(err, ErrInvalidP))
+}
+
+func TestShardedHllAddMany(t *testing.T) {
+	batched, err := NewSharded(4, WithP(12))
+	assert.Equal(t, nil, err)
+	single, err := NewSharded(4, WithP(12))
+	assert.Equal(t, nil, err)
+
+	xs := randUint64s(t, 100)
+	batched.AddMany(xs)
+	for _, x := range xs {
+		single.Add(x)
+	}
+	for i := range batched.shards {
+		assert.Equal(t, batched.shards[i].h.Cardinality(), single.shards[i].h.Cardinality())
+	}
+	assert.Equal(t, batched.Cardinality(), single.Cardinality())
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
 
 	"github.com/golang/snappy"
 )
@@ -36,18 +37,21 @@ func (s *sparse) Copy() *sparse {
 }
 
 func (s *sparse) Add(x uint64) {
-	delta := x - s.lastVal
-
-	// This slice is not strictly necessary, but it saves a lot of complexity. For now, simplicity
-	// trumps performance in this case.
-	deltaBuf := make([]byte, binary.MaxVarintLen64)
-
-	n := binary.PutUvarint(deltaBuf, delta)
-	s.buf = append(s.buf, deltaBuf[0:n]...)
+	s.buf = appendUvarint(s.buf, x-s.lastVal)
 	s.lastVal = x
 	s.numElements++
 }
 
+// Appends the varint encoding of x to buf. This is the same encoding as binary.PutUvarint, but it
+// doesn't need a separate buffer.
+func appendUvarint(buf []byte, x uint64) []byte {
+	for x >= 0x80 {
+		buf = append(buf, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(buf, byte(x))
+}
+
 func (s *sparse) SizeInBits() uint64 {
 	return uint64(len(s.buf) * 8)
 }
@@ -72,6 +76,45 @@ func (s *sparse) GetIterator() u64It {
 	}
 }
 
+// The largest a sparse list can be: it has an encoded hash for at most every dense index, and a
+// varint delta takes at most binary.MaxVarintLen64 bytes.
+func maxSparseBytes(p uint) uint64 {
+	return binary.MaxVarintLen64 << p
+}
+
+// Checks that s is a sparse list that merge could have built for p and pPrime: numElements valid
+// encoded hashes, sorted by strictly increasing index, the last one being lastVal. It returns an
+// error that wraps ErrInvalidEncoding if it isn't.
+func (s *sparse) validate(p, pPrime uint) error {
+	if s.numElements > 1<<p || uint64(len(s.buf)) > maxSparseBytes(p) {
+		return fmt.Errorf("%w: sparse list of %d elements in %d bytes is too large for p=%d",
+			ErrInvalidEncoding, s.numElements, len(s.buf), p)
+	}
+	var k, lastIndex, numElements uint64
+	for buf := s.buf; len(buf) > 0; numElements++ {
+		delta, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return fmt.Errorf("%w: bad varint in the sparse list", ErrInvalidEncoding)
+		}
+		buf = buf[n:]
+		k += delta
+		if !isValidHashCode(k, p, pPrime) {
+			return fmt.Errorf("%w: %#x isn't an encoded hash for p=%d, pPrime=%d", ErrInvalidEncoding,
+				k, p, pPrime)
+		}
+		idx := getIndex(k, p, pPrime)
+		if numElements > 0 && idx <= lastIndex {
+			return fmt.Errorf("%w: sparse list isn't sorted by index", ErrInvalidEncoding)
+		}
+		lastIndex = idx
+	}
+	if numElements != s.numElements || k != s.lastVal {
+		return fmt.Errorf("%w: sparse list has %d elements ending with %#x, expected %d ending "+
+			"with %#x", ErrInvalidEncoding, numElements, k, s.numElements, s.lastVal)
+	}
+	return nil
+}
+
 func (s *sparse) GetNumElements() uint64 {
 	return s.numElements
 }
@@ -121,7 +164,7 @@ func unsnappyB64(in []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	uncompressed, err := snappy.Decode(nil, unBase64ed[:n])
+	uncompressed, err := snappyDecode(unBase64ed[:n], maxSparseBytes(maxP))
 	if err != nil {
 		return nil, err
 	}
@@ -133,3 +176,16 @@ func unsnappyB64(in []byte) ([]byte, error) {
 	}
 	return uncompressed, nil
 }
+
+// Decodes the snappy-encoded src, unless it would decode to more than maxLen bytes. This keeps a
+// few bytes of untrusted input from allocating gigabytes.
+func snappyDecode(src []byte, maxLen uint64) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(n) > maxLen {
+		return nil, fmt.Errorf("snappy: decoded length %d is larger than %d", n, maxLen)
+	}
+	return snappy.Decode(nil, src)
+}
@@ -1,6 +1,7 @@
 package hll
 
 import (
+	"encoding/binary"
 	"testing"
 
 	"github.com/bmizerany/assert"
@@ -24,3 +25,11 @@ func TestSparse(t *testing.T) {
 	_, ok := iter()
 	assert.T(t, !ok)
 }
+
+func TestAppendUvarint(t *testing.T) {
+	for _, x := range []uint64{0, 1, 127, 128, 300, 1 << 35, 1<<64 - 1} {
+		expected := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(expected, x)
+		assert.Equal(t, appendUvarint([]byte{1}, x), append([]byte{1}, expected[:n]...))
+	}
+}
@@ -1,7 +1,9 @@
 package hll
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math/bits"
 	"sort"
 )
 
@@ -10,14 +12,14 @@ import (
 // encode the position of a bit in a 64-bit sequence (log2(64)==6).
 
 // Return the position of the first set bit, starting with 1. This is the same as the number of
-// leading zeros + 1. Returns 63 if no bits were set. Since the result is in [1,63] it can be
-// encoded in 6 bits.
+// trailing zeros + 1. Returns 63 if none of the low 62 bits were set. Since the result is in [1,63]
+// it can be encoded in 6 bits.
 func rho(x uint64) uint8 {
-	var i uint8
-	for i = 0; i < 62 && x&1 == 0; i++ {
-		x >>= 1
+	tz := bits.TrailingZeros64(x)
+	if tz > 62 {
+		tz = 62
 	}
-	return i + 1
+	return uint8(tz) + 1
 }
 
 // x is a hash code.
@@ -37,6 +39,20 @@ func encodeHash(x uint64, p, pPrime uint) (hashCode uint64) {
 	}
 }
 
+// Reports whether k could have been returned by encodeHash: its sparse index has pPrime bits, the
+// flag is set exactly when the pPrime-p bits after the dense index are zero, and a flagged hash has
+// the rho of 64-pPrime low-order bits, which is at most 64-pPrime, or 63 if they're all zero.
+func isValidHashCode(k uint64, p, pPrime uint) bool {
+	afterP := uint64(1)<<(pPrime-p) - 1
+	if k&1 == 1 {
+		sparseIdx, r := k>>7, extractShift(k, 1, 6)
+		return sparseIdx>>pPrime == 0 && sparseIdx&afterP == 0 &&
+			(r != 0 && r <= uint64(64-pPrime) || r == uint64(rho(0)))
+	}
+	sparseIdx := k >> 1
+	return sparseIdx>>pPrime == 0 && sparseIdx&afterP != 0
+}
+
 // k is an encoded hash.
 // In the version of the paper that we're using, there are two off-by-one errors in GetIndex() in
 // Figure 7. We pointed these out to the authors, and they updated the appendix at
@@ -55,7 +71,9 @@ func getIndex(k uint64, p, pPrime uint) uint64 {
 func decodeHash(k uint64, p, pPrime uint) (idx uint64, rhoW uint8) {
 	var r uint8
 	if k&1 == 1 {
-		r = uint8(extractShift(k, 1, 6) + uint64(pPrime-p))
+		// The rho of an encoded hash whose low bits are all zero is 63, which is as large as a
+		// register gets.
+		r = uint8(minU64(extractShift(k, 1, 6)+uint64(pPrime-p), 63))
 	} else {
 		r = rho(extractShift(k, 1, pPrime-p-1))
 	}
@@ -153,6 +171,96 @@ func merge(p, pPrime uint, sizeEst uint64, it1, it2 u64It) *sparse {
 	return output
 }
 
+// Merges the encoded hashes in sorted into s. sorted must be sorted by sortHashcodesByIndex. The
+// result is the same as merge() would give, but nothing is allocated once the buffers are large
+// enough: the merged list is written to spare, and s's old buffer is returned so that it can be the
+// spare for the next merge.
+func (s *sparse) mergeSorted(p, pPrime uint, sorted []uint64, spare []byte) []byte {
+	leftIt := mergeReader{buf: s.buf, p: p, pPrime: pPrime}
+	rightIt := mergeReader{xs: sorted, fromSlice: true, p: p, pPrime: pPrime}
+
+	left, haveLeft := leftIt.next()
+	right, haveRight := rightIt.next()
+
+	out := spare[:0]
+	var lastVal, numElements uint64
+	add := func(k uint64) {
+		out = appendUvarint(out, k-lastVal)
+		lastVal = k
+		numElements++
+	}
+
+	for haveLeft && haveRight {
+		if left.index < right.index {
+			add(left.encoded)
+			left, haveLeft = leftIt.next()
+		} else if right.index < left.index {
+			add(right.encoded)
+			right, haveRight = rightIt.next()
+		} else { // The indexes are equal. Keep the one with the highest rho value.
+			if left.rho > right.rho {
+				add(left.encoded)
+			} else {
+				add(right.encoded)
+			}
+			left, haveLeft = leftIt.next()
+			right, haveRight = rightIt.next()
+		}
+	}
+	for ; haveRight; right, haveRight = rightIt.next() {
+		add(right.encoded)
+	}
+	for ; haveLeft; left, haveLeft = leftIt.next() {
+		add(left.encoded)
+	}
+
+	old := s.buf
+	s.buf, s.lastVal, s.numElements = out, lastVal, numElements
+	return old
+}
+
+// Yields the elements of a sparse list buffer or of a sorted slice of encoded hashes for merging,
+// and discards duplicate indexes the way makeMergeElemIter does. Unlike the iterators, it doesn't
+// allocate.
+type mergeReader struct {
+	buf       []byte   // The varint-encoded deltas that are left, when reading a sparse list.
+	xs        []uint64 // The encoded hashes that are left, when reading a slice.
+	fromSlice bool
+	lastVal   uint64 // The last value decoded from buf.
+
+	p, pPrime uint
+	started   bool
+	lastIndex uint64
+}
+
+func (r *mergeReader) next() (mergeElem, bool) {
+	for {
+		var hashCode uint64
+		if r.fromSlice {
+			if len(r.xs) == 0 {
+				return mergeElem{}, false
+			}
+			hashCode, r.xs = r.xs[0], r.xs[1:]
+		} else {
+			delta, n := binary.Uvarint(r.buf)
+			if n <= 0 {
+				return mergeElem{}, false
+			}
+			r.buf = r.buf[n:]
+			r.lastVal += delta
+			hashCode = r.lastVal
+		}
+
+		idx, rho := decodeHash(hashCode, r.p, r.pPrime)
+		if r.started && idx == r.lastIndex {
+			continue
+		}
+		r.started = true
+		r.lastIndex = idx
+		return mergeElem{idx, rho, hashCode}, true
+	}
+}
+
 func toNormal(s *sparse, p, pPrime uint) normal {
 	m := 1 << p
 	M := newNormal(uint64(m))
@@ -177,6 +285,13 @@ func maxU8(x, y uint8) uint8 {
 	return y
 }
 
+func minU8(x, y uint8) uint8 {
+	if x <= y {
+		return x
+	}
+	return y
+}
+
 func maxU64(x, y uint64) uint64 {
 	if x >= y {
 		return x
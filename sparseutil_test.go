@@ -32,6 +32,10 @@ func TestRho(t *testing.T) {
 		{1, 1},
 		{0, 63},
 		{4, 3},
+		{1 << 61, 62},
+		{1 << 62, 63},
+		{1 << 63, 63},
+		{0xAABBCCDD00112210, 5},
 	}
 
 	for i, testCase := range testCases {
@@ -86,6 +90,47 @@ func TestMerge(t *testing.T) {
 	}
 }
 
+// mergeSorted should give exactly the same sparse list as merge.
+func TestMergeSorted(t *testing.T) {
+	const p, pPrime = 12, 25
+
+	encode := func(xs []uint64) []uint64 {
+		for i, x := range xs {
+			xs[i] = encodeHash(x, p, pPrime)
+		}
+		sortHashcodesByIndex(xs, p, pPrime)
+		return xs
+	}
+
+	var spare []byte
+	s := newSparse(0)
+	for i := 0; i < 5; i++ {
+		sorted := encode(randUint64s(t, 100))
+		if i > 0 {
+			// Duplicates of the sparse list's own elements are merged too. lastVal is already an
+			// encoded hash.
+			sorted = append(sorted, s.lastVal)
+			sortHashcodesByIndex(sorted, p, pPrime)
+		}
+
+		expected := merge(p, pPrime, 0, s.GetIterator(), makeU64SliceIt(sorted))
+		oldBuf := s.buf
+		spare = s.mergeSorted(p, pPrime, sorted, spare)
+
+		assert.Equal(t, s.buf, expected.buf)
+		assert.Equal(t, s.lastVal, expected.lastVal)
+		assert.Equal(t, s.numElements, expected.numElements)
+		assert.Equal(t, spare, oldBuf)
+
+		// Merging only a duplicate doesn't change the list.
+		before := s.Copy()
+		spare = s.mergeSorted(p, pPrime, []uint64{s.lastVal}, spare)
+		assert.Equal(t, s.numElements, before.numElements)
+		assert.Equal(t, s.buf, before.buf)
+		assert.Equal(t, s.lastVal, before.lastVal)
+	}
+}
+
 func randUint64s(t *testing.T, count int) []uint64 {
 	output := make([]uint64, count)
 	for i := 0; i < count; i++ {
@@ -0,0 +1,234 @@
+package hll
+
+import (
+	"sync"
+)
+
+// SyncHll is an Hll that's safe for concurrent use by multiple goroutines.
+//
+// An Hll isn't safe for concurrent use, even for calls that look like reads: Cardinality and the
+// marshaling functions merge the temp set into the sparse list. SyncHll guards its Hll with a mutex,
+// and does the expensive part of those calls on a snapshot, outside of the mutex. Taking a snapshot
+// is a copy, so readers don't block writers for the sort and merge of the temp set or for the
+// cardinality calculation. The last cardinality is cached until the next change.
+//
+// Create a SyncHll with NewSync or NewSyncHll. A zero SyncHll can only be unmarshaled into.
+type SyncHll struct {
+	mu      sync.Mutex
+	h       *Hll
+	version uint64 // incremented by every change to h
+
+	cacheOK      bool   // whether cachedEst is valid
+	cacheVersion uint64 // the version that cachedEst was computed from
+	cachedEst    Estimate
+}
+
+// NewSyncHll returns a SyncHll that wraps h. The SyncHll takes ownership of h, so h must not be used
+// directly afterwards.
+func NewSyncHll(h *Hll) *SyncHll {
+	return &SyncHll{h: h}
+}
+
+// NewSync is like New, but returns a SyncHll.
+func NewSync(opts ...Option) (*SyncHll, error) {
+	h, err := New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewSyncHll(h), nil
+}
+
+// Add is like Hll.Add.
+func (s *SyncHll) Add(x uint64) {
+	s.mu.Lock()
+	s.h.Add(x)
+	s.version++
+	s.mu.Unlock()
+}
+
+// AddMany is like Hll.AddMany. The mutex is held for the whole batch.
+func (s *SyncHll) AddMany(xs []uint64) {
+	s.mu.Lock()
+	s.h.AddMany(xs)
+	s.version++
+	s.mu.Unlock()
+}
+
+// AddBytes is like Hll.AddBytes.
+func (s *SyncHll) AddBytes(b []byte) {
+	s.mu.Lock()
+	s.h.AddBytes(b)
+	s.version++
+	s.mu.Unlock()
+}
+
+// AddString is like Hll.AddString.
+func (s *SyncHll) AddString(str string) {
+	s.mu.Lock()
+	s.h.AddString(str)
+	s.version++
+	s.mu.Unlock()
+}
+
+// AddUint64Value is like Hll.AddUint64Value.
+func (s *SyncHll) AddUint64Value(v uint64) {
+	s.mu.Lock()
+	s.h.AddUint64Value(v)
+	s.version++
+	s.mu.Unlock()
+}
+
+// Snapshot returns a copy of the current state of the sketch. The copy is an ordinary Hll owned by
+// the caller.
+func (s *SyncHll) Snapshot() *Hll {
+	snapshot, _ := s.snapshot()
+	return snapshot
+}
+
+// Returns a copy of the Hll and the version it was copied at.
+func (s *SyncHll) snapshot() (*Hll, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.h.Copy(), s.version
+}
+
+// Cardinality is like Hll.Cardinality. It's computed on a snapshot, and cached until the sketch
+// changes.
+func (s *SyncHll) Cardinality() uint64 {
+	return s.Estimate().Cardinality
+}
+
+// Estimate is like Hll.Estimate. It's computed on a snapshot, and cached until the sketch changes.
+func (s *SyncHll) Estimate() Estimate {
+	s.mu.Lock()
+	if s.cacheOK && s.cacheVersion == s.version {
+		est := s.cachedEst
+		s.mu.Unlock()
+		return est
+	}
+	snapshot, version := s.h.Copy(), s.version
+	s.mu.Unlock()
+
+	est := snapshot.Estimate()
+
+	s.mu.Lock()
+	// Another reader may have cached a newer estimate in the meantime.
+	if !s.cacheOK || version > s.cacheVersion {
+		s.cacheOK, s.cacheVersion, s.cachedEst = true, version, est
+	}
+	s.mu.Unlock()
+	return est
+}
+
+// EstimateAt is like Hll.EstimateAt. It's computed on a snapshot.
+func (s *SyncHll) EstimateAt(confidence float64) (Estimate, error) {
+	return s.Snapshot().EstimateAt(confidence)
+}
+
+// HashID is like Hll.HashID.
+func (s *SyncHll) HashID() HashID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.h.HashID()
+}
+
+// Combine merges other into s. Unlike Hll.Combine, other is never modified (see
+// Hll.CombineReadOnly), but it must not be modified by another goroutine during the call.
+//
+// Combine panics if the sketches can't be combined. Use CombineE to get an error instead.
+func (s *SyncHll) Combine(other *Hll) {
+	if err := s.CombineE(other); err != nil {
+		panic(err.Error())
+	}
+}
+
+// CombineE is like Combine, but returns an error instead of panicking if the sketches can't be
+// combined (see Hll.CombineE).
+func (s *SyncHll) CombineE(other *Hll) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.h.CombineReadOnly(other); err != nil {
+		return err
+	}
+	s.version++
+	return nil
+}
+
+// CombineSync merges a snapshot of other into s. It's safe to call while other is in use by other
+// goroutines, and with other == s.
+func (s *SyncHll) CombineSync(other *SyncHll) error {
+	// Taking the snapshot first means that the two locks are never held at the same time.
+	return s.CombineE(other.Snapshot())
+}
+
+// MarshalJSON is like Hll.MarshalJSON. It marshals a snapshot.
+func (s *SyncHll) MarshalJSON() ([]byte, error) {
+	return s.Snapshot().MarshalJSON()
+}
+
+// UnmarshalJSON is like Hll.UnmarshalJSON. It replaces the state of the sketch.
+func (s *SyncHll) UnmarshalJSON(buf []byte) error {
+	h := &Hll{}
+	if err := h.UnmarshalJSON(buf); err != nil {
+		return err
+	}
+	s.replace(h)
+	return nil
+}
+
+// MarshalPb is like Hll.MarshalPb. It marshals a snapshot.
+func (s *SyncHll) MarshalPb() ([]byte, error) {
+	return s.Snapshot().MarshalPb()
+}
+
+// UnmarshalPb is like Hll.UnmarshalPb. It replaces the state of the sketch.
+func (s *SyncHll) UnmarshalPb(buf []byte) error {
+	h := &Hll{}
+	if err := h.UnmarshalPb(buf); err != nil {
+		return err
+	}
+	s.replace(h)
+	return nil
+}
+
+// MarshalBinary is like Hll.MarshalBinary. It marshals a snapshot.
+func (s *SyncHll) MarshalBinary() ([]byte, error) {
+	return s.Snapshot().MarshalBinary()
+}
+
+// MarshalBinaryCompressed is like Hll.MarshalBinaryCompressed. It marshals a snapshot.
+func (s *SyncHll) MarshalBinaryCompressed() ([]byte, error) {
+	return s.Snapshot().MarshalBinaryCompressed()
+}
+
+// UnmarshalBinary is like Hll.UnmarshalBinary. It replaces the state of the sketch.
+func (s *SyncHll) UnmarshalBinary(buf []byte) error {
+	h := &Hll{}
+	if err := h.UnmarshalBinary(buf); err != nil {
+		return err
+	}
+	s.replace(h)
+	return nil
+}
+
+// GobEncode is like Hll.GobEncode. It encodes a snapshot.
+func (s *SyncHll) GobEncode() ([]byte, error) {
+	return s.Snapshot().GobEncode()
+}
+
+// GobDecode is like Hll.GobDecode. It replaces the state of the sketch.
+func (s *SyncHll) GobDecode(data []byte) error {
+	h := &Hll{}
+	if err := h.GobDecode(data); err != nil {
+		return err
+	}
+	s.replace(h)
+	return nil
+}
+
+func (s *SyncHll) replace(h *Hll) {
+	s.mu.Lock()
+	s.h = h
+	s.version++
+	s.mu.Unlock()
+}
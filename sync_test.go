@@ -0,0 +1,127 @@
+package hll
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// Many goroutines adding and reading at once should give the same result as adding serially. Run
+// with -race to check the locking.
+//
+// Both sketches start dense. A sparse sketch places a hash in a different register than a dense one
+// does (see getIndex), so the registers would depend on which hashes arrived before the switch to
+// the dense representation, and that depends on how the goroutines interleave. Once dense, adding
+// takes the maximum of each register, which doesn't depend on the order.
+func TestSyncHllConcurrent(t *testing.T) {
+	const goroutines, perGoroutine = 8, 5000
+
+	s, err := NewSync(WithP(12))
+	assert.Equal(t, nil, err)
+	s.h.switchToNormal()
+	expected := NewHll(12, 25)
+	expected.switchToNormal()
+
+	inputs := make([][]uint64, goroutines)
+	for i := range inputs {
+		inputs[i] = randUint64s(t, perGoroutine)
+		for _, x := range inputs[i] {
+			expected.Add(x)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(inputs []uint64) {
+			defer wg.Done()
+			for j, x := range inputs {
+				s.Add(x)
+				if j%500 == 0 {
+					s.Cardinality()
+					if _, err := s.MarshalJSON(); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(inputs[i])
+	}
+	wg.Wait()
+
+	snapshot := s.Snapshot()
+	assert.Equal(t, snapshot.bigM, expected.bigM)
+	assert.Equal(t, s.Cardinality(), expected.Cardinality())
+}
+
+func TestSyncHllCache(t *testing.T) {
+	s := NewSyncHll(NewHll(14, 25))
+	s.AddString("a")
+	assert.Equal(t, s.Cardinality(), uint64(1))
+	assert.T(t, s.cacheOK)
+	assert.Equal(t, s.cacheVersion, uint64(1))
+
+	// Adding invalidates the cache.
+	s.AddString("b")
+	assert.Equal(t, s.Cardinality(), uint64(2))
+	assert.Equal(t, s.cacheVersion, uint64(2))
+	s.AddMany([]uint64{XXHash64{}.Sum64([]byte("a")), XXHash64{}.Sum64([]byte("c"))})
+	assert.Equal(t, s.Cardinality(), uint64(3))
+	assert.Equal(t, s.cacheVersion, uint64(3))
+
+	// The snapshot belongs to the caller.
+	snapshot := s.Snapshot()
+	snapshot.AddString("d")
+	assert.Equal(t, s.Cardinality(), uint64(3))
+	assert.Equal(t, s.Estimate(), s.Snapshot().Estimate())
+}
+
+func TestSyncHllCombine(t *testing.T) {
+	a, b := NewSyncHll(NewHll(12, 25)), NewHll(12, 25)
+	for _, x := range randUint64s(t, 50) {
+		a.Add(x)
+	}
+	for _, x := range randUint64s(t, 50) {
+		b.Add(x)
+	}
+	tempSet := len(b.tempSet)
+
+	expected, err := Union(a.Snapshot(), b)
+	assert.Equal(t, nil, err)
+	a.Combine(b)
+	assert.Equal(t, len(b.tempSet), tempSet)
+	assert.Equal(t, a.Cardinality(), expected.Cardinality())
+
+	// Combining a sketch with itself doesn't deadlock or change it.
+	assert.Equal(t, a.CombineSync(a), nil)
+	assert.Equal(t, a.Cardinality(), expected.Cardinality())
+
+	assert.T(t, errors.Is(a.CombineE(NewHll(14, 25)), ErrPrecisionMismatch))
+}
+
+func TestSyncHllMarshal(t *testing.T) {
+	s := NewSyncHll(NewHll(12, 25))
+	for _, x := range randUint64s(t, 10000) {
+		s.Add(x)
+	}
+
+	buf, err := json.Marshal(s)
+	assert.Equal(t, nil, err)
+	fromJSON := &SyncHll{}
+	assert.Equal(t, json.Unmarshal(buf, fromJSON), nil)
+	assert.Equal(t, fromJSON.Cardinality(), s.Cardinality())
+
+	buf, err = s.MarshalPb()
+	assert.Equal(t, nil, err)
+	fromPb := &SyncHll{}
+	assert.Equal(t, fromPb.UnmarshalPb(buf), nil)
+	assert.Equal(t, fromPb.Cardinality(), s.Cardinality())
+
+	buf, err = s.GobEncode()
+	assert.Equal(t, nil, err)
+	fromGob := &SyncHll{}
+	assert.Equal(t, fromGob.GobDecode(buf), nil)
+	assert.Equal(t, fromGob.Cardinality(), s.Cardinality())
+}
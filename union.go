@@ -0,0 +1,143 @@
+package hll
+
+import (
+	"container/heap"
+	"errors"
+)
+
+// ErrNoSketches is returned by UnionAll when it's called without any sketches.
+var ErrNoSketches = errors.New("hll: no sketches to union")
+
+// UnionAll returns a new Hll estimating the cardinality of the union of the inputs of all of the
+// given sketches. None of the sketches is modified. All of them must have the same p and pPrime,
+// otherwise a *PrecisionMismatchError is returned, and must not record different hash functions,
+// otherwise a *HashMismatchError is returned.
+//
+// This is faster than calling Combine repeatedly. The sparse lists of all the inputs are merged in
+// a single k-way merge instead of building an intermediate sparse list for each input, and the
+// result switches to the dense representation as soon as its sparse list would cross the sparse
+// threshold.
+func UnionAll(sketches ...*Hll) (*Hll, error) {
+	if len(sketches) == 0 {
+		return nil, ErrNoSketches
+	}
+	first := sketches[0]
+	hashID := first.hashID
+	for _, other := range sketches[1:] {
+		if err := first.checkCombinable(other); err != nil {
+			return nil, err
+		}
+		// The first sketch's hash function may be unknown, so check against the first known one.
+		if err := checkHashIDs(hashID, other.hashID); err != nil {
+			return nil, err
+		}
+		if hashID.IsZero() {
+			hashID = other.hashID
+		}
+	}
+
+	union, err := New(WithP(first.p), WithPPrime(first.pPrime),
+		WithSparseThresholdBits(first.sparseThresholdBits), WithMergeSizeBits(first.mergeSizeBits),
+		WithHasher(first.hasher), WithHashID(hashID), withLayout(first.layout),
+		WithChecksum(first.checksum))
+	if err != nil {
+		return nil, err
+	}
+	union.mergeAll(sketches)
+	return union, nil
+}
+
+// Merges the sketches into the empty sketch h in a single k-way merge. The sketches must have
+// the same p and pPrime as h.
+func (h *Hll) mergeAll(sketches []*Hll) {
+	// The projected size of the union is the size of all the inputs put together. Every element of
+	// a temp set takes at least one byte once it's in a sparse list.
+	var projectedBits uint64
+	for _, other := range sketches {
+		if !other.isSparse {
+			projectedBits = h.sparseThresholdBits + 1
+			break
+		}
+		projectedBits += other.sparseList.SizeInBits() + uint64(len(other.tempSet))*8
+	}
+
+	if projectedBits > h.sparseThresholdBits {
+		h.switchToNormal()
+		for _, other := range sketches {
+			h.combine(other, other.readOnlySparse())
+		}
+		return
+	}
+
+	its := make(mergeHeap, 0, len(sketches))
+	for _, other := range sketches {
+		it := makeMergeElemIter(other.p, other.pPrime, other.readOnlySparse().GetIterator())
+		if elem, ok := it(); ok {
+			its = append(its, mergeHeapItem{elem, it})
+		}
+	}
+	heap.Init(&its)
+
+	output := h.sparseList
+	var lastIndex uint64
+	for len(its) > 0 {
+		elem := its[0].elem
+		if next, ok := its[0].it(); ok {
+			its[0].elem = next
+			heap.Fix(&its, 0)
+		} else {
+			heap.Pop(&its)
+		}
+
+		// The heap yields the element with the highest rho first for each index, so any later
+		// elements with the same index can be discarded.
+		if output.GetNumElements() > 0 && elem.index == lastIndex {
+			continue
+		}
+		lastIndex = elem.index
+
+		if h.isSparse {
+			output.Add(elem.encoded)
+			if output.SizeInBits() > h.sparseThresholdBits {
+				h.switchToNormal()
+			}
+		} else {
+			h.maxRegister(elem.index, elem.rho)
+		}
+	}
+}
+
+type mergeHeapItem struct {
+	elem mergeElem // The next element of it.
+	it   mergeElemIt
+}
+
+// A heap of sparse list iterators, ordered by the index of their next element. Elements with the
+// same index are ordered by descending rho.
+type mergeHeap []mergeHeapItem
+
+func (m mergeHeap) Len() int {
+	return len(m)
+}
+
+func (m mergeHeap) Less(i, j int) bool {
+	if m[i].elem.index != m[j].elem.index {
+		return m[i].elem.index < m[j].elem.index
+	}
+	return m[i].elem.rho > m[j].elem.rho
+}
+
+func (m mergeHeap) Swap(i, j int) {
+	m[i], m[j] = m[j], m[i]
+}
+
+func (m *mergeHeap) Push(x interface{}) {
+	*m = append(*m, x.(mergeHeapItem))
+}
+
+func (m *mergeHeap) Pop() interface{} {
+	old := *m
+	item := old[len(old)-1]
+	*m = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,63 @@
+package hll
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// UnionAll should give the same result as combining the sketches one at a time.
+func TestUnionAll(t *testing.T) {
+	testCases := []struct {
+		counts         []int
+		mergeSizeBits  uint64
+		shouldBeSparse bool
+	}{
+		{[]int{10}, 0, true},
+		{[]int{10, 20, 30, 40}, 0, true},
+		{[]int{50, 50, 50, 50, 50, 50, 50, 50}, 0, true},
+		{[]int{300, 300, 300, 300, 300, 300, 300, 300}, 0, false}, // Projected to be too big.
+		{[]int{10, 10000, 10}, 0, false},                          // One dense input.
+		// Large temp sets are projected to be small, so the threshold is crossed mid-merge.
+		{[]int{300, 300, 300, 300, 300, 300, 300, 300}, 6 << 12, false},
+	}
+
+	for i, testCase := range testCases {
+		var sketches []*Hll
+		combined := NewHll(12, 25)
+		for _, count := range testCase.counts {
+			h, err := New(WithP(12), WithPPrime(25), WithMergeSizeBits(testCase.mergeSizeBits))
+			assert.Equal(t, nil, err)
+			for _, x := range randUint64s(t, count) {
+				h.Add(x)
+			}
+			combined.Combine(h.Copy())
+			sketches = append(sketches, h)
+		}
+		before := make([]int, len(sketches))
+		for j, h := range sketches {
+			before[j] = len(h.tempSet)
+		}
+
+		union, err := UnionAll(sketches...)
+		assert.Equal(t, nil, err)
+		if union.isSparse != testCase.shouldBeSparse {
+			t.Errorf("Testcase %d: expected isSparse %v but was %v", i, testCase.shouldBeSparse,
+				union.isSparse)
+		}
+		assert.Equalf(t, union.Cardinality(), combined.Cardinality(), "Testcase %d", i)
+
+		for j, h := range sketches {
+			assert.Equalf(t, len(h.tempSet), before[j], "Testcase %d: input was modified", i)
+		}
+	}
+}
+
+func TestUnionAllErrors(t *testing.T) {
+	_, err := UnionAll()
+	assert.Equal(t, err, ErrNoSketches)
+
+	_, err = UnionAll(NewHll(12, 25), NewHll(12, 25), NewHll(14, 25))
+	assert.T(t, errors.Is(err, ErrPrecisionMismatch))
+}
@@ -0,0 +1,70 @@
+package hll
+
+// unpacked is a layout of the dense registers with a whole byte per register (see
+// WithUnpackedRegisters). It takes a third more memory than normal, but a register is read or
+// written without any shifting or masking, and merging is a byte-wise max.
+type unpacked []uint8
+
+func newUnpacked(numRegisters uint64) unpacked {
+	return make(unpacked, numRegisters)
+}
+
+// Returns the unpacked copy of the first numRegisters packed registers of n. The number of
+// registers must be a multiple of 4, which it always is for 2^p registers.
+func unpack(n normal, numRegisters uint64) unpacked {
+	u := newUnpacked(numRegisters)
+	for g := uint64(0); g < numRegisters/4; g++ {
+		regs := n.getGroup(g)
+		copy(u[g*4:g*4+4], regs[:])
+	}
+	return u
+}
+
+func (u unpacked) Get(registerIdx uint64) uint8 {
+	return u[registerIdx]
+}
+
+func (u unpacked) Set(registerIdx uint64, val uint8) {
+	u[registerIdx] = val
+}
+
+func (u unpacked) clone() registers {
+	cp := make(unpacked, len(u))
+	copy(cp, u)
+	return cp
+}
+
+func (u unpacked) histogram(numRegisters uint64) *registerHist {
+	hist := &registerHist{}
+	for _, r := range u[:numRegisters] {
+		hist[r]++
+	}
+	return hist
+}
+
+func (u unpacked) maxMerge(other registers, numRegisters uint64, hist *registerHist) {
+	o, ok := other.(unpacked)
+	if !ok {
+		maxMergeRegisters(u, other, numRegisters, hist)
+		return
+	}
+	u, o = u[:numRegisters], o[:numRegisters]
+	for i, r := range o {
+		if old := u[i]; r > old {
+			u[i] = r
+			if hist != nil {
+				hist[old]--
+				hist[r]++
+			}
+		}
+	}
+}
+
+func (u unpacked) packed(numRegisters uint64) normal {
+	n := newNormal(numRegisters)
+	for g := uint64(0); g < numRegisters/4; g++ {
+		b := u[g*4 : g*4+4]
+		n.setGroup(g, [4]uint8{b[0], b[1], b[2], b[3]})
+	}
+	return n
+}
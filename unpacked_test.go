@@ -0,0 +1,23 @@
+package hll
+
+import (
+	mrand "math/rand"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestUnpackRoundTrip(t *testing.T) {
+	const numRegisters = 1 << 10
+	n := newNormal(numRegisters)
+	for i := uint64(0); i < numRegisters; i++ {
+		n.Set(i, uint8(mrand.Intn(64)))
+	}
+
+	u := unpack(n, numRegisters)
+	for i := uint64(0); i < numRegisters; i++ {
+		assert.Equal(t, u.Get(i), n.Get(i))
+	}
+	assert.Equal(t, u.packed(numRegisters), n)
+	assert.Equal(t, *u.histogram(numRegisters), *n.histogram(numRegisters))
+}
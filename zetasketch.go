@@ -0,0 +1,375 @@
+package hll
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// ZetaSketch (https://github.com/google/zetasketch), which BigQuery's HLL_COUNT functions use,
+// stores HLL++ sketches as an AggregatorStateProto with a HyperLogLogPlusUniqueStateProto extension.
+// Only these fields are used; others are skipped when reading:
+//
+//	AggregatorStateProto
+//	  1   type                             varint, zetaAggregatorType
+//	  2   num_values                       varint, the number of values added
+//	  3   encoding_version                 varint, zetaEncodingVersion
+//	  4   value_type                       varint, the type of the values that were added
+//	  112 hyperloglogplus_unique_state     message
+//
+//	HyperLogLogPlusUniqueStateProto
+//	  2   sparse_size                      varint, the number of sparse values
+//	  3   precision_or_num_buckets         varint, p
+//	  4   sparse_precision_or_num_buckets  varint, the sparse precision, p'
+//	  5   data                             bytes, the 2^p registers, one per byte
+//	  6   sparse_data                      bytes, the sparse values
+//
+// The sparse values are sorted, and each is written as the varint difference from the one before
+// it. A sparse value is the p'-bit sparse index, unless the p'-p bits of the sparse index after the
+// register index are zero. Then it's the flag bit 1<<max(p', p+6), the p-bit register index and 6
+// bits of rho(w'). This is the encoding of the HLL++ paper, which the sparse list also uses, except
+// that the sparse list keeps the whole sparse index in the second case.
+const (
+	zetaAggregatorType  = 112
+	zetaEncodingVersion = 2
+	zetaRhoBits         = 6
+)
+
+// The field numbers of the protos above.
+const (
+	zetaFieldType            = 1
+	zetaFieldNumValues       = 2
+	zetaFieldEncodingVersion = 3
+	zetaFieldValueType       = 4
+	zetaFieldHllState        = 112
+
+	zetaFieldSparseSize      = 2
+	zetaFieldPrecision       = 3
+	zetaFieldSparsePrecision = 4
+	zetaFieldData            = 5
+	zetaFieldSparseData      = 6
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// ErrInvalidZetaSketch is matched (using errors.Is) by the errors returned when ImportZetaSketch is
+// given a buffer that isn't a ZetaSketch HLL++ sketch, or one that an Hll can't represent.
+var ErrInvalidZetaSketch = errors.New("hll: invalid ZetaSketch HLL++ sketch")
+
+// ZetaSketchHasherName is the HashID name of sketches imported by ImportZetaSketch. ZetaSketch
+// hashes values with a 64-bit fingerprint that depends on their type, so the seed of the HashID is
+// the value_type of the sketch. This package doesn't provide a Hasher for it; one can be registered
+// under this name with RegisterHasher, or set with SetHasher.
+//
+// Such a Hasher should return the fingerprint with the bits below the top p reversed: ZetaSketch
+// counts the leading zeros below the register index, and an Hll counts the trailing zeros of the
+// hash. Then a dense Hll sets the same registers that ZetaSketch does. The sparse values still
+// differ, so the same value added to sparse sketches on both sides is only counted once after the
+// sketches are dense.
+const ZetaSketchHasherName = "zetasketch"
+
+// ImportZetaSketch replaces h with the ZetaSketch HLL++ sketch in buf, such as the BYTES that
+// BigQuery's HLL_COUNT.INIT returns. The result has the sketch's precision and sparse precision, and
+// the HashID {ZetaSketchHasherName, value_type}, so it can only be combined with sketches that use
+// the same hash function or whose hash function isn't known.
+//
+// A dense sketch keeps its registers. A sparse sketch's values set the registers that ZetaSketch
+// sets when it converts the sketch to a dense one, so the result is dense unless the sketch is
+// empty. They can't be kept in the sparse list, which tells values apart by other bits of the
+// sparse index than ZetaSketch does.
+//
+// It returns an error that wraps ErrInvalidZetaSketch if buf isn't a valid sketch, or if its
+// precision is outside of [4,18] or its sparse precision is outside of (p,57].
+func (h *Hll) ImportZetaSketch(buf []byte) error {
+	var typ, version, valueType uint64
+	var state []byte
+	err := readProtoFields(buf, func(field, wireType, x uint64, data []byte) {
+		switch {
+		case field == zetaFieldType && wireType == wireVarint:
+			typ = x
+		case field == zetaFieldEncodingVersion && wireType == wireVarint:
+			version = x
+		case field == zetaFieldValueType && wireType == wireVarint:
+			valueType = x
+		case field == zetaFieldHllState && wireType == wireBytes:
+			state = data
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if typ != zetaAggregatorType {
+		return fmt.Errorf("%w: aggregator type %d, expected %d", ErrInvalidZetaSketch, typ,
+			zetaAggregatorType)
+	}
+	if version != zetaEncodingVersion {
+		return fmt.Errorf("%w: encoding version %d, expected %d", ErrInvalidZetaSketch, version,
+			zetaEncodingVersion)
+	}
+
+	var sparseSize, p, pPrime uint64
+	var data, sparseData []byte
+	haveSparseSize := false
+	err = readProtoFields(state, func(field, wireType, x uint64, b []byte) {
+		switch {
+		case field == zetaFieldSparseSize && wireType == wireVarint:
+			sparseSize, haveSparseSize = x, true
+		case field == zetaFieldPrecision && wireType == wireVarint:
+			p = x
+		case field == zetaFieldSparsePrecision && wireType == wireVarint:
+			pPrime = x
+		case field == zetaFieldData && wireType == wireBytes:
+			data = b
+		case field == zetaFieldSparseData && wireType == wireBytes:
+			sparseData = b
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if p < minP || p > maxP {
+		return fmt.Errorf("%w: precision %d is outside of [%d,%d]", ErrInvalidZetaSketch, p, minP,
+			maxP)
+	}
+	// ZetaSketch may leave out the sparse precision of a sketch that's never sparse.
+	if pPrime == 0 && sparseData == nil {
+		pPrime = defaultPPrime
+	}
+	decoded, err := New(WithP(uint(p)), WithPPrime(uint(pPrime)))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidZetaSketch, err)
+	}
+	decoded.hashID = HashID{ZetaSketchHasherName, valueType}
+
+	regs := newNormal(decoded.m)
+	switch {
+	case data != nil && sparseData != nil:
+		return fmt.Errorf("%w: both dense and sparse data", ErrInvalidZetaSketch)
+	case data != nil:
+		if uint64(len(data)) != decoded.m {
+			return fmt.Errorf("%w: %d registers, expected %d", ErrInvalidZetaSketch, len(data),
+				decoded.m)
+		}
+		for i, val := range data {
+			if val > 64-uint8(p)+1 {
+				return fmt.Errorf("%w: register %d is %d", ErrInvalidZetaSketch, i, val)
+			}
+			regs.Set(uint64(i), val)
+		}
+	default:
+		n, err := readZetaSparse(sparseData, uint(p), uint(pPrime), regs)
+		if err != nil {
+			return err
+		}
+		if haveSparseSize && n != sparseSize {
+			return fmt.Errorf("%w: %d sparse values, expected %d", ErrInvalidZetaSketch, n,
+				sparseSize)
+		}
+		if n == 0 {
+			regs = nil // An empty sketch stays sparse.
+		}
+	}
+	if regs != nil {
+		decoded.isSparse = false
+		decoded.sparseList = nil
+		decoded.bigM = decoded.layout.fromPacked(regs, decoded.m)
+		decoded.hist = decoded.bigM.histogram(decoded.m)
+	}
+
+	*h = *decoded
+	return nil
+}
+
+// Sets the registers of the sparse values in regs the way ZetaSketch does, and returns the number
+// of values. A value is in the register given by the top p bits of its sparse index. ZetaSketch's
+// rho(w) counts leading zeros, so the rho of a sparse index alone is the number of leading zeros
+// in its last p'-p bits plus one, and a flagged rho(w') is offset by p'-p.
+func readZetaSparse(buf []byte, p, pPrime uint, regs normal) (uint64, error) {
+	flag := uint64(1) << maxU64(uint64(pPrime), uint64(p+zetaRhoBits))
+	maxRho := uint64(64 - pPrime + 1)
+	var n, val uint64
+	for len(buf) > 0 {
+		delta, rest, err := readZetaUvarint(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 && delta == 0 {
+			return 0, fmt.Errorf("%w: sparse values aren't in ascending order",
+				ErrInvalidZetaSketch)
+		}
+		buf, val, n = rest, val+delta, n+1
+
+		var idx, r uint64
+		switch {
+		case val&flag == 0:
+			// The sparse index alone; the bits after the register index aren't all zero.
+			if val>>pPrime != 0 || val&(1<<(pPrime-p)-1) == 0 {
+				return 0, fmt.Errorf("%w: bad sparse value %#x", ErrInvalidZetaSketch, val)
+			}
+			idx = val >> (pPrime - p)
+			r = uint64(bits.LeadingZeros64(val<<(64-(pPrime-p)))) + 1
+		default:
+			idx, r = (val^flag)>>zetaRhoBits, val&(1<<zetaRhoBits-1)
+			if idx>>p != 0 || r == 0 || r > maxRho {
+				return 0, fmt.Errorf("%w: bad sparse value %#x", ErrInvalidZetaSketch, val)
+			}
+			r += uint64(pPrime - p)
+		}
+		regs.Set(idx, maxU8(regs.Get(idx), uint8(r)))
+	}
+	return n, nil
+}
+
+// ExportZetaSketch returns h as a ZetaSketch HLL++ sketch, which BigQuery's HLL_COUNT.MERGE and
+// HLL_COUNT.EXTRACT accept. A sparse sketch is exported sparse, with h's sparse precision, and a
+// dense one is exported with its registers. num_values is written as 0, since an Hll doesn't count
+// the values added to it, and value_type is only written for a sketch that was imported with
+// ImportZetaSketch.
+//
+// h must have a precision of at least 10 and a sparse precision of at most 25, as ZetaSketch
+// requires, otherwise a *PrecisionMismatchError is returned. It must use an unknown hash function
+// or the one named by ZetaSketchHasherName, otherwise a *HashMismatchError is returned.
+//
+// ZetaSketch's rho(w) is at most 65-p, for a hash whose bits after the register index are all
+// zero. An Hll gives such a hash a larger rho when the register index ends in zeros, so a larger
+// register is exported as 65-p, which is what ZetaSketch gives the same hash. Likewise, a flagged
+// sparse value's rho(w') is at most 65-p'.
+func (h *Hll) ExportZetaSketch() ([]byte, error) {
+	const minZetaP, maxZetaPPrime = 10, 25
+	if h.p < minZetaP || h.pPrime > maxZetaPPrime {
+		otherP := h.p
+		if otherP < minZetaP {
+			otherP = minZetaP
+		}
+		return nil, &PrecisionMismatchError{h.p, h.pPrime, otherP, minUint(h.pPrime, maxZetaPPrime)}
+	}
+	if !h.hashID.IsZero() && h.hashID.Name != ZetaSketchHasherName {
+		return nil, &HashMismatchError{h.hashID, HashID{Name: ZetaSketchHasherName}}
+	}
+	h.mergeTmpSetIfAny()
+
+	var state []byte
+	state = appendProtoVarint(state, zetaFieldPrecision, uint64(h.p))
+	state = appendProtoVarint(state, zetaFieldSparsePrecision, uint64(h.pPrime))
+	if h.isSparse {
+		values := zetaSparseValues(h.sparseList, h.p, h.pPrime)
+		var sparseData []byte
+		var last uint64
+		for _, val := range values {
+			sparseData = appendUvarint(sparseData, val-last)
+			last = val
+		}
+		state = appendProtoVarint(state, zetaFieldSparseSize, uint64(len(values)))
+		state = appendProtoBytes(state, zetaFieldSparseData, sparseData)
+	} else {
+		data := make([]byte, h.m)
+		maxRho := uint8(64 - h.p + 1)
+		for i := range data {
+			data[i] = minU8(h.bigM.Get(uint64(i)), maxRho)
+		}
+		state = appendProtoBytes(state, zetaFieldData, data)
+	}
+
+	var buf []byte
+	buf = appendProtoVarint(buf, zetaFieldType, zetaAggregatorType)
+	buf = appendProtoVarint(buf, zetaFieldNumValues, 0)
+	buf = appendProtoVarint(buf, zetaFieldEncodingVersion, zetaEncodingVersion)
+	if h.hashID.Seed != 0 {
+		buf = appendProtoVarint(buf, zetaFieldValueType, h.hashID.Seed)
+	}
+	return appendProtoBytes(buf, zetaFieldHllState, state), nil
+}
+
+// Returns the sorted ZetaSketch sparse values of the encoded hashes in s.
+func zetaSparseValues(s *sparse, p, pPrime uint) []uint64 {
+	flag := uint64(1) << maxU64(uint64(pPrime), uint64(p+zetaRhoBits))
+	maxRho := uint64(64 - pPrime + 1)
+	values := make([]uint64, 0, s.GetNumElements())
+	it := s.GetIterator()
+	for k, ok := it(); ok; k, ok = it() {
+		if k&1 == 0 {
+			values = append(values, k>>1)
+		} else {
+			idx, r := k>>7>>(pPrime-p), minU64(k>>1&(1<<zetaRhoBits-1), maxRho)
+			values = append(values, flag|idx<<zetaRhoBits|r)
+		}
+	}
+	sort.Sort(uint64Slice(values))
+	return values
+}
+
+type uint64Slice []uint64
+
+func (s uint64Slice) Len() int           { return len(s) }
+func (s uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Calls f with each field of the protobuf message in buf. x is the value of a varint or fixed
+// field, and data is the value of a length-delimited one.
+func readProtoFields(buf []byte, f func(field, wireType, x uint64, data []byte)) error {
+	for len(buf) > 0 {
+		key, rest, err := readZetaUvarint(buf)
+		if err != nil {
+			return err
+		}
+		buf = rest
+		field, wireType := key>>3, key&7
+		var x uint64
+		var data []byte
+		switch wireType {
+		case wireVarint:
+			if x, buf, err = readZetaUvarint(buf); err != nil {
+				return err
+			}
+		case wireFixed64, wireFixed32:
+			n := 8
+			if wireType == wireFixed32 {
+				n = 4
+			}
+			if len(buf) < n {
+				return fmt.Errorf("%w: truncated field %d", ErrInvalidZetaSketch, field)
+			}
+			for i := n - 1; i >= 0; i-- {
+				x = x<<8 | uint64(buf[i])
+			}
+			buf = buf[n:]
+		case wireBytes:
+			var n uint64
+			if n, buf, err = readZetaUvarint(buf); err != nil {
+				return err
+			}
+			if n > uint64(len(buf)) {
+				return fmt.Errorf("%w: truncated field %d", ErrInvalidZetaSketch, field)
+			}
+			data, buf = buf[:n:n], buf[n:]
+		default:
+			return fmt.Errorf("%w: unsupported wire type %d", ErrInvalidZetaSketch, wireType)
+		}
+		f(field, wireType, x, data)
+	}
+	return nil
+}
+
+func readZetaUvarint(buf []byte) (uint64, []byte, error) {
+	x, rest, err := readUvarint(buf, "ZetaSketch varint")
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: bad varint", ErrInvalidZetaSketch)
+	}
+	return x, rest, nil
+}
+
+func appendProtoVarint(buf []byte, field, x uint64) []byte {
+	return appendUvarint(appendUvarint(buf, field<<3|wireVarint), x)
+}
+
+func appendProtoBytes(buf []byte, field uint64, data []byte) []byte {
+	buf = appendUvarint(appendUvarint(buf, field<<3|wireBytes), uint64(len(data)))
+	return append(buf, data...)
+}
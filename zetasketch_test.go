@@ -0,0 +1,187 @@
+package hll
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// Returns a ZetaSketch proto with the given state fields, and value_type 9.
+func zetaProto(state []byte) []byte {
+	var buf []byte
+	buf = appendProtoVarint(buf, zetaFieldType, zetaAggregatorType)
+	buf = appendProtoVarint(buf, zetaFieldNumValues, 3)
+	buf = appendProtoVarint(buf, zetaFieldEncodingVersion, zetaEncodingVersion)
+	buf = appendProtoVarint(buf, zetaFieldValueType, 9)
+	// An unknown field, which is skipped.
+	buf = appendProtoBytes(buf, 100, []byte("ignored"))
+	return appendProtoBytes(buf, zetaFieldHllState, state)
+}
+
+func TestImportZetaSketch(t *testing.T) {
+	// With p=10 and p'=15, the flag is 1<<16. A sparse index alone is in the register given by its
+	// top 10 bits, and its rho is the number of leading zeros of its last 5 bits plus one, as
+	// ZetaSketch counts them: 3<<5|00001 sets register 3 to 5, and 700<<5|00100 and 700<<5|10000
+	// set register 700 to 3 and 1. The last value is register 7 with rho(w')=4, so it's 4+5.
+	var state []byte
+	state = appendProtoVarint(state, zetaFieldSparseSize, 4)
+	state = appendProtoVarint(state, zetaFieldPrecision, 10)
+	state = appendProtoVarint(state, zetaFieldSparsePrecision, 15)
+	var sparseData []byte
+	var last uint64
+	for _, val := range []uint64{3<<5 | 1, 700<<5 | 4, 700<<5 | 16, 1<<16 | 7<<6 | 4} {
+		sparseData = appendUvarint(sparseData, val-last)
+		last = val
+	}
+	state = appendProtoBytes(state, zetaFieldSparseData, sparseData)
+	buf := zetaProto(state)
+
+	h := &Hll{}
+	assert.Equal(t, h.ImportZetaSketch(buf), nil)
+	assert.Equal(t, h.p, uint(10))
+	assert.Equal(t, h.pPrime, uint(15))
+	assert.Equal(t, h.HashID(), HashID{ZetaSketchHasherName, 9})
+	assert.T(t, !h.isSparse)
+	expectedRegs := map[uint64]uint8{3: 5, 7: 9, 700: 3}
+	for i := uint64(0); i < h.m; i++ {
+		assert.Equalf(t, h.bigM.Get(i), expectedRegs[i], "register %d", i)
+	}
+	assert.Equal(t, h.Cardinality(), uint64(3))
+
+	// Exporting gives the registers. num_values isn't kept.
+	exported, err := h.ExportZetaSketch()
+	assert.Equal(t, nil, err)
+	data := make([]byte, 1024)
+	for i, val := range expectedRegs {
+		data[i] = val
+	}
+	expected := appendProtoVarint(nil, zetaFieldPrecision, 10)
+	expected = appendProtoVarint(expected, zetaFieldSparsePrecision, 15)
+	expected = appendProtoBytes(expected, zetaFieldData, data)
+	var expectedBuf []byte
+	expectedBuf = appendProtoVarint(expectedBuf, zetaFieldType, zetaAggregatorType)
+	expectedBuf = appendProtoVarint(expectedBuf, zetaFieldNumValues, 0)
+	expectedBuf = appendProtoVarint(expectedBuf, zetaFieldEncodingVersion, zetaEncodingVersion)
+	expectedBuf = appendProtoVarint(expectedBuf, zetaFieldValueType, 9)
+	expectedBuf = appendProtoBytes(expectedBuf, zetaFieldHllState, expected)
+	assert.Equal(t, exported, expectedBuf)
+
+	// An empty sketch stays sparse.
+	state = appendProtoVarint(nil, zetaFieldPrecision, 10)
+	state = appendProtoVarint(state, zetaFieldSparsePrecision, 15)
+	assert.Equal(t, h.ImportZetaSketch(zetaProto(state)), nil)
+	assert.T(t, h.isSparse)
+	assert.Equal(t, h.Cardinality(), uint64(0))
+}
+
+func TestZetaSketchRoundTrip(t *testing.T) {
+	for _, numHashes := range []int{0, 100, 1000000} {
+		h, err := New(WithP(15), WithPPrime(20))
+		assert.Equal(t, nil, err)
+		h.AddMany(randUint64s(t, numHashes))
+
+		buf, err := h.ExportZetaSketch()
+		assert.Equal(t, nil, err)
+		rt := &Hll{}
+		assert.Equal(t, rt.ImportZetaSketch(buf), nil)
+		if h.isSparse && numHashes > 0 {
+			// The sparse values are imported dense, in the registers of the top bits of the hashes.
+			assert.T(t, !rt.isSparse)
+			regs := h.exportRegisters()
+			for i := uint64(0); i < h.m; i++ {
+				assert.Equalf(t, rt.bigM.Get(i) != 0, regs.Get(i) != 0, "register %d", i)
+			}
+			h = rt
+			buf, err = h.ExportZetaSketch()
+			assert.Equal(t, nil, err)
+			rt = &Hll{}
+			assert.Equal(t, rt.ImportZetaSketch(buf), nil)
+		}
+		assert.Equal(t, rt.isSparse, h.isSparse)
+		if h.isSparse {
+			assert.Equal(t, rt.sparseList, h.sparseList)
+		} else {
+			assert.Equal(t, rt.bigM, h.bigM)
+		}
+		assert.Equal(t, rt.Cardinality(), h.Cardinality())
+
+		again, err := rt.ExportZetaSketch()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, again, buf)
+	}
+}
+
+func TestExportZetaSketchMaxRho(t *testing.T) {
+	// The bits of the hash after the register index are zero, so ZetaSketch's rho(w) is 65-p=51,
+	// but an Hll counts the zeros at the end of the register index too.
+	const x = 4 << 50
+	dense, sparse := NewHll(14, 20), NewHll(14, 20)
+	dense.switchToNormal()
+	dense.Add(x)
+	sparse.Add(x)
+	assert.Equal(t, dense.bigM.Get(4), uint8(53))
+
+	for _, h := range []*Hll{dense, sparse} {
+		buf, err := h.ExportZetaSketch()
+		assert.Equal(t, nil, err)
+		rt := &Hll{}
+		assert.Equal(t, rt.ImportZetaSketch(buf), nil)
+		assert.Equal(t, rt.bigM.Get(4), uint8(51))
+	}
+}
+
+func TestExportZetaSketchErrors(t *testing.T) {
+	_, err := NewHll(9, 20).ExportZetaSketch()
+	assert.T(t, errors.Is(err, ErrPrecisionMismatch))
+	_, err = NewHll(14, 26).ExportZetaSketch()
+	assert.T(t, errors.Is(err, ErrPrecisionMismatch))
+
+	h, err := New(WithP(14), WithPPrime(20), WithHasher(XXHash64{}))
+	assert.Equal(t, nil, err)
+	h.AddString("a")
+	_, err = h.ExportZetaSketch()
+	assert.T(t, errors.Is(err, ErrHashMismatch))
+}
+
+func TestImportZetaSketchErrors(t *testing.T) {
+	header := func(p, pPrime uint64) []byte {
+		state := appendProtoVarint(nil, zetaFieldPrecision, p)
+		return appendProtoVarint(state, zetaFieldSparsePrecision, pPrime)
+	}
+	sparseData := func(values ...uint64) []byte {
+		var buf []byte
+		var last uint64
+		for _, val := range values {
+			buf = appendUvarint(buf, val-last)
+			last = val
+		}
+		return appendProtoBytes(header(10, 15), zetaFieldSparseData, buf)
+	}
+	testCases := [][]byte{
+		nil,
+		{0x08},       // Truncated varint
+		{0x0a, 0x05}, // Truncated bytes
+		{0x0b},       // Unsupported wire type
+		appendProtoVarint(nil, zetaFieldType, 100),
+		appendProtoVarint(appendProtoVarint(nil, zetaFieldType, zetaAggregatorType),
+			zetaFieldEncodingVersion, 1),
+		zetaProto(header(19, 25)),
+		zetaProto(header(10, 10)),
+		zetaProto(appendProtoBytes(header(10, 15), zetaFieldData, make([]byte, 1023))),
+		zetaProto(appendProtoBytes(header(10, 15), zetaFieldData, append(make([]byte, 1023), 56))),
+		zetaProto(appendProtoBytes(appendProtoBytes(header(10, 15), zetaFieldData,
+			make([]byte, 1024)), zetaFieldSparseData, []byte{1})),
+		zetaProto(sparseData(3 << 5)),            // The bits after the register index are zero
+		zetaProto(sparseData(1 << 15)),           // Larger than the sparse index
+		zetaProto(sparseData(1<<17 | 1<<16 | 1)), // Register index too large
+		zetaProto(sparseData(1<<16 | 7<<6)),      // rho(w') of zero
+		zetaProto(sparseData(1, 1)),              // Not ascending
+		zetaProto(append(appendProtoVarint(nil, zetaFieldSparseSize, 2), sparseData(1)...)),
+	}
+	for i, buf := range testCases {
+		h := &Hll{}
+		err := h.ImportZetaSketch(buf)
+		assert.Tf(t, errors.Is(err, ErrInvalidZetaSketch), "Testcase %d: %v", i, err)
+	}
+}